@@ -1,10 +1,17 @@
 package timer
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/robfig/cron/v3"
@@ -17,210 +24,2918 @@ const (
 	RemovedStatus = "removed"
 )
 
+const (
+	// RunningState 单个任务的状态
+	RunningState = "running"
+	PausedState  = "paused"
+)
+
+// OverlapPolicy 任务上一次执行尚未结束时 新一次执行的处理策略
+type OverlapPolicy int
+
+const (
+	// OverlapAllow 允许多次执行同时进行 与 AddTaskByFunc 行为一致
+	OverlapAllow OverlapPolicy = iota
+	// OverlapSkip 上一次执行尚未结束时 直接丢弃本次执行
+	OverlapSkip
+	// OverlapDelay 上一次执行结束后再开始本次执行 多次执行串行进行
+	OverlapDelay
+)
+
+// OnceDuplicatePolicy 添加一次性任务时同名任务已经存在的处理策略
+type OnceDuplicatePolicy int
+
+const (
+	// OnceReject 返回已有任务的 EntryID 和 ErrTaskExists 默认策略
+	OnceReject OnceDuplicatePolicy = iota
+	// OnceReplace 新任务添加成功后删除已有任务 计时从新任务添加时重新开始 可以用于防抖 添加失败时保留已有任务
+	OnceReplace
+	// OnceIgnore 保留已有任务 丢弃新任务 返回已有任务的 EntryID 和 nil 已有任务按原来的时间执行
+	OnceIgnore
+)
+
+// Priority 任务的优先级 只对没有option的任务生效
+type Priority int
+
+const (
+	// PriorityNormal 默认优先级 核心cron忙碌时分配到动态cron
+	PriorityNormal Priority = iota
+	// PriorityHigh 高优先级 总是分配到核心cron 核心cron忙碌时会把一个普通优先级的任务迁移到动态cron
+	PriorityHigh
+)
+
+// EventType 任务事件的类型
+type EventType string
+
+const (
+	EventAdded   EventType = "added"
+	EventRemoved EventType = "removed"
+	EventPaused  EventType = "paused"
+	EventResumed EventType = "resumed"
+	EventReaped  EventType = "reaped" // 动态cron实例被回收 TaskName 为空
+)
+
+// TaskEvent 任务生命周期的变化
+type TaskEvent struct {
+	TaskName string
+	Type     EventType
+	Time     time.Time
+}
+
+const (
+	// eventBufferSize 每个事件订阅者的缓冲区大小 缓冲区满时丢弃新的事件
+	eventBufferSize = 64
+	// defaultBusyThreshold 单个cron实例默认承载的任务数 达到后标记为忙碌
+	defaultBusyThreshold = 20
+	// defaultIdleCheckInterval 默认每个小时检查一次空闲的动态cron
+	defaultIdleCheckInterval = time.Hour
+	// defaultIdleTTL 动态cron默认空闲2小时后销毁
+	defaultIdleTTL = 2 * time.Hour
+)
+
+var (
+	// ErrTaskExists 同名任务已经存在
+	ErrTaskExists = errors.New("任务已经启动")
+	// ErrTimerClosed TaskTimer 已经关闭
+	ErrTimerClosed = errors.New("定时器已经关闭")
+	// ErrTaskNotFound 任务不存在
+	ErrTaskNotFound = errors.New("任务不存在")
+	// ErrEntryInvalid 任务在cron中的条目已经失效
+	ErrEntryInvalid = errors.New("任务条目已失效")
+	// ErrCloseTimeout 关闭时等待正在执行的任务超时
+	ErrCloseTimeout = errors.New("等待任务执行完成超时")
+	// ErrWaitTimeout 等待单个任务(DrainTask/WaitForRuns)超时 与关闭定时器无关
+	ErrWaitTimeout = errors.New("等待任务超时")
+	// ErrNilLocation 未指定时区
+	ErrNilLocation = errors.New("时区不能为空")
+	// ErrPoolFull 动态cron数量达到上限 且没有可以承载任务的实例
+	ErrPoolFull = errors.New("cron实例数量已达上限")
+	// ErrTimeInPast 指定的执行时间已经过去
+	ErrTimeInPast = errors.New("执行时间已经过去")
+	// ErrReaperStalled 空闲检查协程超过预期时间没有运行
+	ErrReaperStalled = errors.New("空闲检查协程已停止运行")
+	// ErrTaskTimeout 任务执行超过了设置的超时时间
+	ErrTaskTimeout = errors.New("任务执行超时")
+	// ErrPoolSaturated 所有可用的cron实例都已忙碌 且动态cron数量已达上限
+	ErrPoolSaturated = errors.New("cron实例均已忙碌")
+	// ErrSpecUnreachable spec可以解析 但永远不会执行 例如2月30日
+	ErrSpecUnreachable = errors.New("执行计划永远不会触发")
+	// ErrJobNoName 任务没有实现 Name() string 或返回空字符串
+	ErrJobNoName = errors.New("任务没有提供名称")
+	// ErrEntryAmbiguous 多个任务使用相同的 EntryID EntryID 只在同一个cron实例内唯一
+	ErrEntryAmbiguous = errors.New("多个任务使用相同的EntryID")
+	// ErrNotScheduled 任务没有下一次执行时间 例如已暂停或一次性任务已经执行
+	ErrNotScheduled = errors.New("任务没有下一次执行时间")
+	// ErrNilSchedule 执行计划为空
+	ErrNilSchedule = errors.New("执行计划不能为空")
+)
+
+// TaskError 记录出错的任务名和操作 Err 为底层的错误 例如cron解析spec的错误
+type TaskError struct {
+	Name string // 任务名
+	Op   string // 出错的操作 例如 "add"
+	Err  error
+}
+
+func (e *TaskError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Name, e.Err)
+}
+
+// Unwrap 返回底层错误 便于使用 errors.Is/errors.As 判断
+func (e *TaskError) Unwrap() error {
+	return e.Err
+}
+
 // cronManager 管理每个任务名对应的cron实例和其下的任务ID
 type cronManager struct {
 	cronInst *cron.Cron
-	status   string // "idle" or "busy" or "removing"
-	option   []cron.Option
+	status   string        // "idle" or "busy" or "removing"
+	option   []cron.Option // 添加任务时指定的option
+	allOpt   []cron.Option // 创建cron实例实际使用的option 包括 TaskTimer 的全局option
+	optKey   string        // option的描述 描述相同的cron实例可以复用
 	lastUsed time.Time
-	mu       sync.Mutex // 保护status
+	mu       sync.Mutex // 保护status和lastUsed
+
+	unlimited bool // 不限制任务数 始终保持空闲 创建后不再修改
+}
+
+// newCronManager 创建并启动cron实例 base 为 TaskTimer 的全局option option 在其之后生效
+func newCronManager(base []cron.Option, option ...cron.Option) *cronManager {
+	allOpt := append(append([]cron.Option{}, base...), option...)
+	timerWorker := cron.New(allOpt...)
+	timerWorker.Start()
+	return &cronManager{
+		cronInst: timerWorker,
+		status:   IdleStatus, // 初始状态为空闲
+		option:   option,
+		allOpt:   allOpt,
+		optKey:   optionKey(option...),
+		lastUsed: time.Now(),
+	}
+}
+
+var (
+	// cron.Option 本身是函数无法比较 这里记录可识别的option构造函数的代码指针
+	locationOptionPtr = reflect.ValueOf(cron.WithLocation(time.UTC)).Pointer()
+	parserOptionPtr   = reflect.ValueOf(cron.WithSeconds()).Pointer()
+
+	// opaqueOptionSeq 无法识别的option 每次都生成唯一描述 不参与复用
+	opaqueOptionSeq uint64
+
+	// parserProbes 用于探测解析器支持的格式
+	parserProbes = []string{"* * * * * *", "* * * * *", "@every 1s"}
+
+	// offsetProbes 用于区分同名的时区 分别取冬季和夏季的偏移
+	offsetProbes = []time.Time{
+		time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2000, time.July, 1, 0, 0, 0, 0, time.UTC),
+	}
+)
+
+// optionsFromKey 根据 optionKey 生成的描述还原option 无法识别的option和自定义的解析器无法还原 返回错误
+func optionsFromKey(key string) ([]cron.Option, error) {
+	var (
+		option  []cron.Option
+		locName string
+		offsets string
+	)
+	if strings.HasPrefix(key, "opaque#") {
+		return nil, fmt.Errorf("无法还原的option %s", key)
+	}
+	for _, field := range strings.Split(key, ";") {
+		name, value, _ := strings.Cut(field, "=")
+		switch name {
+		case "loc":
+			locName = value
+		case "offset":
+			offsets = value
+		case "parser":
+			_, parseOpt, _ := strings.Cut(value, "/")
+			n, err := strconv.ParseUint(parseOpt, 10, 32)
+			if err != nil { // 自定义的解析器实现按指针区分 无法还原
+				return nil, fmt.Errorf("无法还原的解析器 %s", value)
+			}
+			option = append(option, cron.WithParser(cron.NewParser(cron.ParseOption(n))))
+		}
+	}
+	if locName != "" {
+		loc, err := locationFromKey(locName, offsets)
+		if err != nil {
+			return nil, err
+		}
+		option = append(option, cron.WithLocation(loc))
+	}
+	return option, nil
+}
+
+// locationFromKey 按名称加载时区 偏移与描述不一致或者无法加载时 使用固定偏移的时区
+func locationFromKey(name, offsets string) (*time.Location, error) {
+	loc, err := time.LoadLocation(name)
+	if offsets == "" {
+		return loc, err
+	}
+	if err == nil && locationOffsets(loc) == offsets {
+		return loc, nil
+	}
+	winter, summer, _ := strings.Cut(offsets, ",")
+	if winter != summer {
+		return nil, fmt.Errorf("无法还原时区 %s(%s)", name, offsets)
+	}
+	offset, err := strconv.Atoi(winter)
+	if err != nil {
+		return nil, err
+	}
+	return time.FixedZone(name, offset), nil
+}
+
+// locationOffsets 时区在 offsetProbes 时刻的偏移秒数 用逗号分隔
+func locationOffsets(loc *time.Location) string {
+	offsets := make([]string, len(offsetProbes))
+	for i, at := range offsetProbes {
+		_, offset := at.In(loc).Zone()
+		offsets[i] = strconv.Itoa(offset)
+	}
+	return strings.Join(offsets, ",")
+}
+
+// parserKey 返回cron实例使用的解析器的描述 WithSeconds 和 WithParser 是同一个构造函数 无法通过代码指针区分
+// 因此读取cron内部的解析器 cron.Parser 按其 ParseOption 区分 其他实现按指针区分 无法识别时返回 false
+func parserKey(c *cron.Cron) (string, bool) {
+	field := reflect.ValueOf(c).Elem().FieldByName("parser")
+	if !field.IsValid() || field.Kind() != reflect.Interface || field.IsNil() {
+		return "", false
+	}
+	parser := field.Elem()
+	switch {
+	case parser.Type() == reflect.TypeOf(cron.Parser{}):
+		return strconv.FormatInt(parser.FieldByName("options").Int(), 10), true
+	case parser.Kind() == reflect.Ptr:
+		return fmt.Sprintf("%#x", parser.Pointer()), true
+	}
+	return "", false
+}
+
+// optionKey 生成option的规范化描述 时区和解析器相同的option视为等价
+// 解析器以实际的解析器区分 探测结果只用于阅读 支持的格式相同但规则不同的解析器不会共用实例
+// 无法识别的option(如 WithChain/WithLogger)无法判断是否等价 生成唯一描述
+func optionKey(option ...cron.Option) string {
+	if len(option) == 0 {
+		return ""
+	}
+	for _, opt := range option {
+		ptr := reflect.ValueOf(opt).Pointer()
+		if ptr != locationOptionPtr && ptr != parserOptionPtr {
+			return fmt.Sprintf("opaque#%d", atomic.AddUint64(&opaqueOptionSeq, 1))
+		}
+	}
+	// 使用未启动的cron实例探测option生效后的时区和解析器
+	probe := cron.New(option...)
+	exact, ok := parserKey(probe)
+	if !ok {
+		return fmt.Sprintf("opaque#%d", atomic.AddUint64(&opaqueOptionSeq, 1))
+	}
+	var parser strings.Builder
+	for _, spec := range parserProbes {
+		if _, err := probe.AddFunc(spec, func() {}); err == nil {
+			parser.WriteByte('1')
+		} else {
+			parser.WriteByte('0')
+		}
+	}
+	// 时区按名称和偏移区分 同名但偏移不同的 time.FixedZone 不会共用实例
+	return fmt.Sprintf("loc=%s;offset=%s;parser=%s/%s", probe.Location(), locationOffsets(probe.Location()), parser.String(), exact)
+}
+
+// Stop 停止cron实例 返回的context在正在执行的任务全部结束后关闭
+func (m *cronManager) Stop() context.Context {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status = RemovedStatus // 标记已经被移除
+	return m.cronInst.Stop()
+}
+
+// isEmpty cron实例中没有任何任务时返回 true
+func (m *cronManager) isEmpty() bool {
+	return m.entryCount() == 0
+}
+
+// entryCount 返回cron实例中的任务数
+func (m *cronManager) entryCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.entryCountLocked()
+}
+
+// entryCountLocked 与 entryCount 相同 调用方需持有 m.mu
+func (m *cronManager) entryCountLocked() int {
+	return len(m.cronInst.Entries())
+}
+
+// markAdded 任务加入后更新最近使用时间 任务数达到 threshold 时由空闲转为忙碌 此时返回 true
+func (m *cronManager) markAdded(threshold int, now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastUsed = now
+	if !m.unlimited && m.status == IdleStatus && m.entryCountLocked() >= threshold {
+		m.status = BusyStatus
+		return true
+	}
+	return false
+}
+
+// removeEntry 移除任务并更新最近使用时间 任务数低于 threshold 时由忙碌转为空闲
+func (m *cronManager) removeEntry(id cron.EntryID, threshold int, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cronInst.Remove(id)
+	m.lastUsed = now
+	if m.status == BusyStatus && m.entryCountLocked() < threshold {
+		m.status = IdleStatus
+	}
+}
+
+// lastUsedAt 返回最近一次添加或移除任务的时间
+func (m *cronManager) lastUsedAt() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastUsed
+}
+
+func (m *cronManager) checkIdle() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status == IdleStatus
+}
+
+// validSpec 使用与该cron实例相同的option校验spec 不会注册任务
+func (m *cronManager) validSpec(spec string) error {
+	return parseSpec(spec, m.allOpt...)
+}
+
+// parseSpec 使用未启动的cron实例解析spec 与实际添加任务时的解析规则一致
+func parseSpec(spec string, option ...cron.Option) error {
+	_, err := cron.New(option...).AddFunc(spec, func() {})
+	return err
+}
+
+// checkReachable 使用与该cron实例相同的option解析spec 在 now 之后永远不会执行时返回 ErrSpecUnreachable
+// cron 最多向后查找5年 找不到时 Next 返回零值
+func (m *cronManager) checkReachable(spec string, now time.Time) error {
+	c := cron.New(m.allOpt...)
+	id, err := c.AddFunc(spec, func() {})
+	if err != nil {
+		return err
+	}
+	if c.Entry(id).Schedule.Next(now).IsZero() {
+		return ErrSpecUnreachable
+	}
+	return nil
+}
+
+func (m *cronManager) getStatus() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+type contextKey struct {
+	*cronManager
+	cron.EntryID
+	job      cron.Job           // 原始任务 用于修改计划时重新注册
+	spec     string             // 任务的执行计划
+	schedule cron.Schedule      // 不为空时直接使用 不解析spec
+	paused   bool               // 是否已暂停 暂停时不在cron中
+	labels   []string           // 任务的标签 用于分组操作
+	cancel   context.CancelFunc // 任务上下文的取消函数 Remove/Close 时调用
+	state    *taskState         // 任务的执行状态 多个 contextKey 副本共享
+	priority Priority           // 任务的优先级
+	once     bool               // 一次性任务 替换执行函数时需要重新包装
+	direct   bool               // RunOnceNow 添加的任务 直接在协程中执行 不在cron中
+}
+
+// taskState 记录任务的执行结果 由自身的锁保护 不占用 TaskTimer 的锁
+type taskState struct {
+	mu        sync.Mutex
+	name      string // 当前的任务名 注册时设置 Rename 时更新 包装逻辑通过它上报任务名
+	hasResult bool
+	lastRun   time.Time
+	lastErr   error
+	running   int           // 正在执行的次数
+	idle      chan struct{} // running 降为0时关闭 有等待者时才创建
+
+	runs      uint64        // 执行完成的次数
+	failures  uint64        // 返回错误或panic的次数
+	totalTime time.Duration // 所有执行的总耗时
+	lastStart time.Time     // 最近一次开始执行的时间
+	panicked  bool          // 最近一次执行是否panic
+	detached  uint64        // 超时后分离执行的次数
+
+	debounce *time.Timer // RunNow 防抖的定时器 窗口结束时执行
+
+	historySize int         // 保留的执行记录数 0 表示不记录
+	history     []RunRecord // 环形缓冲区 写满后从 historyNext 处覆盖
+	historyNext int
+}
+
+// RunRecord 一次执行的记录
+type RunRecord struct {
+	Start    time.Time     // 开始执行的时间
+	Duration time.Duration // 执行耗时
+	Err      error         // 返回的错误或panic 成功时为 nil
+}
+
+// appendHistory 记录一次执行 超过 historySize 时覆盖最早的记录 调用方需持有 s.mu
+func (s *taskState) appendHistory(record RunRecord) {
+	if len(s.history) < s.historySize {
+		s.history = append(s.history, record)
+		return
+	}
+	s.history[s.historyNext] = record
+	s.historyNext = (s.historyNext + 1) % s.historySize
+}
+
+// runHistory 按时间顺序返回执行记录的副本 最早的在前
+func (s *taskState) runHistory() []RunRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make([]RunRecord, 0, len(s.history))
+	records = append(records, s.history[s.historyNext:]...)
+	return append(records, s.history[:s.historyNext]...)
+}
+
+func (s *taskState) setResult(at time.Time, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hasResult = true
+	s.lastRun = at
+	s.lastErr = err
+	if err != nil {
+		s.failures++
+	}
+}
+
+func (s *taskState) setName(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+func (s *taskState) taskName() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.name
+}
+
+func (s *taskState) result() (time.Time, error, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastRun, s.lastErr, s.hasResult
+}
+
+// track 包装任务 执行期间 running 计数加一 并累计执行次数和耗时 任务panic时同样会恢复计数
+func (s *taskState) track(job cron.Job, clock Clock) cron.Job {
+	return cron.FuncJob(func() {
+		startAt := clock.Now()
+		s.mu.Lock()
+		s.running++
+		s.lastStart = startAt
+		s.mu.Unlock()
+		start := time.Now()
+		defer func() {
+			r := recover()
+			s.finish(startAt, time.Since(start), r)
+			if r != nil {
+				panic(r)
+			}
+		}()
+		job.Run()
+	})
+}
+
+// finish 一次执行结束 recovered 为任务panic的值 没有正在执行的任务时通知等待者
+func (s *taskState) finish(startAt time.Time, d time.Duration, recovered interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runs++
+	s.totalTime += d
+	s.panicked = recovered != nil
+	if s.panicked {
+		s.failures++
+	}
+	if s.historySize > 0 {
+		record := RunRecord{Start: startAt, Duration: d}
+		if s.panicked {
+			record.Err = fmt.Errorf("任务panic: %v", recovered)
+		} else if s.hasResult {
+			record.Err = s.lastErr
+		}
+		s.appendHistory(record)
+	}
+	s.running--
+	if s.running == 0 && s.idle != nil {
+		close(s.idle)
+		s.idle = nil
+	}
+}
+
+func (s *taskState) isRunning() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running > 0
+}
+
+// succeeded 最近一次执行是否成功 尚未执行过时返回 false
+// 带返回值的任务以最近一次的错误为准 其他任务只要没有panic即为成功
+func (s *taskState) succeeded() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.runs == 0 || s.panicked {
+		return false
+	}
+	return !s.hasResult || s.lastErr == nil
+}
+
+// debounceRun 在 window 内没有新的调用时执行 run 每次调用都会重新计时
+func (s *taskState) debounceRun(window time.Duration, run func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.debounce != nil {
+		s.debounce.Stop()
+	}
+	s.debounce = time.AfterFunc(window, run)
+}
+
+// stopDebounce 取消尚未执行的防抖调用
+func (s *taskState) stopDebounce() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.debounce != nil {
+		s.debounce.Stop()
+		s.debounce = nil
+	}
+}
+
+// stats 返回执行统计
+func (s *taskState) stats() TaskStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := TaskStats{
+		Runs:     s.runs,
+		Failures: s.failures,
+		LastRun:  s.lastStart,
+		Detached: s.detached,
+	}
+	if s.failures < s.runs {
+		stats.Successes = s.runs - s.failures
+	}
+	if s.runs > 0 {
+		stats.AvgDuration = s.totalTime / time.Duration(s.runs)
+	}
+	return stats
+}
+
+// markDetached 记录一次超时后分离的执行
+func (s *taskState) markDetached() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.detached++
+}
+
+// waitIdle 返回的 channel 在没有正在执行的任务时关闭
+func (s *taskState) waitIdle() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running == 0 {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	if s.idle == nil {
+		s.idle = make(chan struct{})
+	}
+	return s.idle
+}
+
+// cancelCtx 取消任务的上下文 没有上下文的任务不做处理
+func (k contextKey) cancelCtx() {
+	if k.cancel != nil {
+		k.cancel()
+	}
+}
+
+// hasLabel 任务是否带有指定的标签
+func (k contextKey) hasLabel(label string) bool {
+	for _, l := range k.labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// TaskTimer 定时任务管理实现
+type TaskTimer struct {
+	taskList    map[string]contextKey
+	coreCron    [2]*cronManager // 保留2个核心cron 无option
+	mu          sync.Mutex      // 保护taskList和cron列表
+	dynamicCron []*cronManager  // 用于存储动态的cron实例
+	stopCheck   chan struct{}
+	checkWg     sync.WaitGroup
+	heartbeat   int64     // 空闲检查协程最近一次运行的时间 UnixNano 原子读写
+	closeOnce   sync.Once // 保证重复调用 Close 不会 panic
+
+	directMgr *cronManager   // RunOnceNow 任务记录使用的占位实例 不启动 不参与分配
+	directWg  sync.WaitGroup // 正在执行的 RunOnceNow 任务 Close 时等待
+	closed    bool           // 是否已经调用过 Close 由 mu 保护
+
+	busyThreshold int                                          // cron实例任务数达到该值时标记为忙碌
+	panicHandler  func(taskName string, recovered interface{}) // 任务panic时的处理函数
+	metrics       MetricsRecorder                              // 任务执行指标的记录器
+	reapHandler   func(c *cron.Cron)                           // 动态cron实例被回收时的回调
+
+	idleCheckInterval time.Duration // 空闲cron的检查间隔
+	idleTTL           time.Duration // 动态cron空闲超过该时间后销毁
+	autoReap          bool          // 是否启动空闲cron检查协程
+	clock             Clock         // 时间来源 用于记录和判断cron实例的空闲时间
+
+	cronOpts       []cron.Option // 所有cron实例共用的全局option
+	maxDynamicCron int           // 动态cron数量上限 0 表示不限制
+	logger         cron.Logger   // cron内部以及任务包装使用的日志
+
+	subscribers []chan TaskEvent           // 任务事件的订阅者 由 mu 保护
+	middlewares []func(next func()) func() // 全局中间件 由 mu 保护
+
+	retryAttempts int           // 返回错误的任务最多执行的次数 包括第一次
+	retryBackoff  time.Duration // 两次重试之间的间隔
+
+	beforeRun func(taskName string)                  // 每次任务执行前的回调
+	afterRun  func(taskName string, d time.Duration) // 每次任务执行后的回调 d 为执行耗时
+
+	validateReachability bool          // 添加任务时检查spec是否会触发
+	jitter               time.Duration // 每次执行前随机等待的最长时间 0 表示不等待
+
+	baseCtx       context.Context             // 所有带上下文任务的父上下文
+	nameValidator func(taskName string) error // 添加任务时校验任务名
+
+	poolSize int         // 执行任务的协程数 0 表示每次执行使用cron创建的协程
+	pool     *workerPool // poolSize>0 时创建
+
+	busyHandler func(managerIndex int)   // cron实例由空闲转为忙碌时的回调
+	oncePolicy  OnceDuplicatePolicy      // 一次性任务同名时的处理策略
+	defaultOpts []cron.Option            // 每个任务默认使用的option
+	debounce    map[string]time.Duration // 任务名对应的 RunNow 防抖窗口
+
+	unlimitedCore bool // 核心cron不受忙碌阈值限制
+	historySize   int  // 每个任务保留的执行记录数
+	detachTimeout bool // 任务执行超时后不再等待 任务在后台继续执行
+
+	dynamicCreated uint64 // 累计创建的动态cron数量 原子读写
+	dynamicReaped  uint64 // 累计销毁的动态cron数量 原子读写
+}
+
+// Clock 时间来源 测试时可以注入自定义的实现
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock 使用系统时间
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// MetricsRecorder 记录任务的执行情况 用于对接 Prometheus 等监控系统
+type MetricsRecorder interface {
+	// ObserveRun 每次任务执行结束后调用 任务panic时 err 不为空
+	ObserveRun(taskName string, duration time.Duration, err error)
+}
+
+// TimerOption 创建 TaskTimer 时的可选配置
+type TimerOption func(*TaskTimer)
+
+// WithBusyThreshold 设置单个cron实例承载的任务数上限 默认20 n<=0 时忽略
+func WithBusyThreshold(n int) TimerOption {
+	return func(t *TaskTimer) {
+		if n > 0 {
+			t.busyThreshold = n
+		}
+	}
+}
+
+// WithPanicHandler 设置任务panic时的处理函数 未设置时不拦截panic 保持原有行为
+func WithPanicHandler(handler func(taskName string, recovered interface{})) TimerOption {
+	return func(t *TaskTimer) {
+		t.panicHandler = handler
+	}
+}
+
+// WithMetrics 设置任务执行指标的记录器 未设置时任务不做额外包装
+func WithMetrics(recorder MetricsRecorder) TimerOption {
+	return func(t *TaskTimer) {
+		t.metrics = recorder
+	}
+}
+
+// WithCronReapHandler 设置动态cron实例被回收后的回调 参数为被回收的cron实例
+// 回调在持有内部锁时调用 不能在回调中调用 TaskTimer 的方法
+func WithCronReapHandler(handler func(c *cron.Cron)) TimerOption {
+	return func(t *TaskTimer) {
+		t.reapHandler = handler
+	}
+}
+
+// WithIdleCheckInterval 设置空闲cron的检查间隔 默认1小时 d<=0 时忽略
+func WithIdleCheckInterval(d time.Duration) TimerOption {
+	return func(t *TaskTimer) {
+		if d > 0 {
+			t.idleCheckInterval = d
+		}
+	}
+}
+
+// WithIdleTTL 设置动态cron空闲多久后销毁 默认2小时 d<=0 时忽略
+func WithIdleTTL(d time.Duration) TimerOption {
+	return func(t *TaskTimer) {
+		if d > 0 {
+			t.idleTTL = d
+		}
+	}
+}
+
+// secondsParser 秒级精度的解析器 秒字段可选 原有的5段spec仍然有效 等同于第0秒执行
+// 与默认解析器一样支持 @yearly @monthly @weekly @daily @hourly 以及 @every <duration> 等描述符
+var secondsParser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// WithSecondsPrecision 所有cron实例使用秒级精度的解析器 支持6段spec(第一段为秒)
+// 为了兼容 5段spec仍然可以使用 会在每分钟的第0秒执行
+func WithSecondsPrecision() TimerOption {
+	return func(t *TaskTimer) {
+		t.cronOpts = append(t.cronOpts, cron.WithParser(secondsParser))
+	}
+}
+
+// WithParser 所有cron实例使用自定义的解析器 完全替换默认的解析器 例如支持年份字段的解析器
+// 添加任务和 ValidateSpec 都使用该解析器 与 WithSecondsPrecision 同时使用时以后设置的为准 p 为 nil 时忽略
+func WithParser(p cron.ScheduleParser) TimerOption {
+	return func(t *TaskTimer) {
+		if p != nil {
+			t.cronOpts = append(t.cronOpts, cron.WithParser(p))
+		}
+	}
+}
+
+// WithLogger 设置所有cron实例使用的日志 l 为 nil 时忽略
+func WithLogger(l cron.Logger) TimerOption {
+	return func(t *TaskTimer) {
+		if l != nil {
+			t.logger = l
+			t.cronOpts = append(t.cronOpts, cron.WithLogger(l))
+		}
+	}
+}
+
+// WithChain 为所有cron实例(包括动态创建的实例)设置 cron.JobWrapper 例如 cron.Recover cron.SkipIfStillRunning
+// 多次调用时后面的会覆盖前面的 添加任务时传入的 cron.WithChain 会覆盖这里的设置 wrappers 为空时忽略
+func WithChain(wrappers ...cron.JobWrapper) TimerOption {
+	return func(t *TaskTimer) {
+		if len(wrappers) > 0 {
+			t.cronOpts = append(t.cronOpts, cron.WithChain(wrappers...))
+		}
+	}
+}
+
+// WithMaxDynamicCrons 设置动态cron实例的数量上限 默认不限制 n<=0 时忽略
+// 达到上限后 新任务会复用option等价且任务最少的动态cron
+func WithMaxDynamicCrons(n int) TimerOption {
+	return func(t *TaskTimer) {
+		if n > 0 {
+			t.maxDynamicCron = n
+		}
+	}
+}
+
+// WithRetry 返回错误的任务(AddTaskByFuncWithResult)失败后自动重试
+// maxAttempts 为最多执行的次数(包括第一次) 重试在同一次执行中进行 会占用该次执行的协程
+// 最终结果通过 LastResult 查询 maxAttempts<=1 时不重试
+func WithRetry(maxAttempts int, backoff time.Duration) TimerOption {
+	return func(t *TaskTimer) {
+		if maxAttempts > 1 {
+			t.retryAttempts = maxAttempts
+			t.retryBackoff = backoff
+		}
+	}
+}
+
+// WithAutoReap 是否自动回收空闲的动态cron 默认开启 关闭后不会启动后台检查协程
+func WithAutoReap(enabled bool) TimerOption {
+	return func(t *TaskTimer) {
+		t.autoReap = enabled
+	}
+}
+
+// WithClock 设置时间来源 默认使用系统时间 c 为 nil 时忽略
+func WithClock(c Clock) TimerOption {
+	return func(t *TaskTimer) {
+		if c != nil {
+			t.clock = c
+		}
+	}
+}
+
+// WithBeforeRun 设置每次任务执行前的回调 比中间件更简单 适合记录日志 hook 为 nil 时忽略
+func WithBeforeRun(hook func(taskName string)) TimerOption {
+	return func(t *TaskTimer) {
+		if hook != nil {
+			t.beforeRun = hook
+		}
+	}
+}
+
+// WithAfterRun 设置每次任务执行后的回调 d 为本次执行的耗时 任务panic时同样会调用 hook 为 nil 时忽略
+func WithAfterRun(hook func(taskName string, d time.Duration)) TimerOption {
+	return func(t *TaskTimer) {
+		if hook != nil {
+			t.afterRun = hook
+		}
+	}
+}
+
+// WithValidateReachability 开启后添加任务时检查spec是否会触发 例如 "0 0 30 2 *" 可以解析但永远不会执行
+// 永远不会执行时返回包装了 ErrSpecUnreachable 的 *TaskError 默认关闭
+func WithValidateReachability(enabled bool) TimerOption {
+	return func(t *TaskTimer) {
+		t.validateReachability = enabled
+	}
+}
+
+// WithJitter 每次执行前随机等待 0 到 max 的时间 打散相同spec的任务同时触发造成的压力
+// 等待发生在cron触发之后 只推迟任务本身的执行 精度相应降低最多 max max<=0 时忽略
+func WithJitter(max time.Duration) TimerOption {
+	return func(t *TaskTimer) {
+		if max > 0 {
+			t.jitter = max
+		}
+	}
+}
+
+// WithBaseContext 设置所有带上下文任务的父上下文 ctx 取消时所有任务的上下文随之取消
+// 并且定时器会自动 Close 之后添加任务返回 ErrTimerClosed ctx 为 nil 时忽略
+func WithBaseContext(ctx context.Context) TimerOption {
+	return func(t *TaskTimer) {
+		if ctx != nil {
+			t.baseCtx = ctx
+		}
+	}
+}
+
+// WithNameValidator 添加任务时先校验任务名 返回错误时不添加任务 错误包装在 *TaskError 中返回
+// 未设置时允许任意任务名 validator 为 nil 时忽略
+func WithNameValidator(validator func(taskName string) error) TimerOption {
+	return func(t *TaskTimer) {
+		if validator != nil {
+			t.nameValidator = validator
+		}
+	}
+}
+
+// WithWorkerPool 使用固定数量的协程执行任务 cron触发时只把任务放入队列 队列长度与 size 相同
+// 队列已满时触发任务的协程会阻塞等待 直到有空闲的协程 任务不会被丢弃 但实际执行时间会推迟
+// Close 会等待队列中的任务全部执行完成 n<=0 时忽略
+func WithWorkerPool(size int) TimerOption {
+	return func(t *TaskTimer) {
+		if size > 0 {
+			t.poolSize = size
+		}
+	}
+}
+
+// WithBusyHandler 设置cron实例由空闲转为忙碌时的回调 managerIndex 与 Distribution 的下标一致
+// 回调在新的协程中执行 不阻塞添加任务 handler 为 nil 时忽略
+func WithBusyHandler(handler func(managerIndex int)) TimerOption {
+	return func(t *TaskTimer) {
+		if handler != nil {
+			t.busyHandler = handler
+		}
+	}
+}
+
+// WithOnceDuplicatePolicy 设置添加一次性任务(OnceTask AddTaskAfter AddTaskAt RunOnceNow)时同名任务已经存在的处理策略
+// 默认 OnceReject 与 AddTaskByFunc 一致 OnceReplace 重新计时 OnceIgnore 保持原来的执行时间
+func WithOnceDuplicatePolicy(policy OnceDuplicatePolicy) TimerOption {
+	return func(t *TaskTimer) {
+		t.oncePolicy = policy
+	}
+}
+
+// WithDefaultOptions 设置每个任务默认使用的option 添加任务时传入的option在默认option之后生效 可以覆盖或扩展默认值
+// 设置后任务都会分配到对应option的动态cron 不再使用核心cron 只想让所有实例使用秒级精度时可以使用 WithSecondsPrecision
+func WithDefaultOptions(opts ...cron.Option) TimerOption {
+	return func(t *TaskTimer) {
+		t.defaultOpts = append(t.defaultOpts, opts...)
+	}
+}
+
+// WithDebounce 为 taskName 的 RunNow 设置防抖窗口 窗口内的多次调用合并为一次 在最后一次调用 window 之后执行
+// 任务被删除时尚未执行的调用会被取消 window<=0 时忽略
+func WithDebounce(taskName string, window time.Duration) TimerOption {
+	return func(t *TaskTimer) {
+		if window <= 0 {
+			return
+		}
+		if t.debounce == nil {
+			t.debounce = make(map[string]time.Duration)
+		}
+		t.debounce[taskName] = window
+	}
+}
+
+// WithUnlimitedCore 核心cron不再受忙碌阈值的限制 始终保持空闲 没有option的任务都会分配到核心cron
+// 减少动态cron的数量和协程 但单个cron实例上的任务会更多 同一时刻触发的任务也更集中 动态cron仍然使用忙碌阈值
+func WithUnlimitedCore(enabled bool) TimerOption {
+	return func(t *TaskTimer) {
+		t.unlimitedCore = enabled
+	}
+}
+
+// WithHistorySize 每个任务保留最近 n 次的执行记录 可以通过 History 查询 默认不保留 n<=0 时忽略
+func WithHistorySize(n int) TimerOption {
+	return func(t *TaskTimer) {
+		if n > 0 {
+			t.historySize = n
+		}
+	}
+}
+
+// WithDetachOnTimeout AddTaskByFuncContextTimeout 的任务执行超时后不再等待任务返回 记录 ErrTaskTimeout 后立即结束本次执行
+// 用于任务不响应上下文取消的情况 保证cron的工作协程和 WithWorkerPool 的协程不会被卡住的任务一直占用
+// 注意 这是以协程泄漏换取可用性 超时的任务会在分离的协程中继续执行直到自己返回 无法被强制结束
+// 如果任务一直不返回 该协程会一直存在 分离后的执行不再计入 IsRunning 也不会被 DrainTask/Close 等待
+// 分离后任务的panic交给 WithPanicHandler 处理 没有设置时记录到日志 分离的次数记录在 Stats 的 Detached 中
+func WithDetachOnTimeout(enabled bool) TimerOption {
+	return func(t *TaskTimer) {
+		t.detachTimeout = enabled
+	}
+}
+
+// NewTaskTimer 创建一个新的 taskTimer 实例
+func NewTaskTimer(opts ...TimerOption) *TaskTimer {
+	t := &TaskTimer{
+		taskList:      make(map[string]contextKey, 10),
+		stopCheck:     make(chan struct{}),
+		busyThreshold: defaultBusyThreshold,
+
+		idleCheckInterval: defaultIdleCheckInterval,
+		idleTTL:           defaultIdleTTL,
+		autoReap:          true,
+		clock:             realClock{},
+		logger:            cron.DefaultLogger,
+		baseCtx:           context.Background(),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if t.poolSize > 0 {
+		t.pool = newWorkerPool(t.poolSize)
+	}
+	// 初始化核心cron
+	t.coreCron[0] = newCronManager(t.cronOpts)
+	t.coreCron[1] = newCronManager(t.cronOpts)
+	t.coreCron[0].unlimited = t.unlimitedCore
+	t.coreCron[1].unlimited = t.unlimitedCore
+	t.directMgr = &cronManager{cronInst: cron.New(), status: RemovedStatus, unlimited: true}
+
+	// 启动空闲cron检查协程
+	if t.autoReap {
+		t.beat()
+		t.checkWg.Add(1)
+		go t.runIdleCheck()
+	}
+	if t.baseCtx.Done() != nil {
+		go t.watchBaseContext()
+	}
+
+	return t
+}
+
+// watchBaseContext 父上下文取消后关闭定时器 不加入 checkWg 因为 Close 会等待 checkWg
+func (t *TaskTimer) watchBaseContext() {
+	select {
+	case <-t.baseCtx.Done():
+		t.Close()
+	case <-t.stopCheck:
+	}
+}
+
+// 使用预占 和 不使用释放预占位
+// 动态cron数量达到上限时 复用option等价且任务最少的动态cron 没有可用实例时返回 ErrPoolFull
+func (t *TaskTimer) getAliveCron(option ...cron.Option) (*cronManager, error) {
+
+	key := optionKey(option...)
+	insMgr := t.idleCron(key, option...) // 实际使用的cron实例
+
+	if insMgr == nil && t.poolLimited() {
+		insMgr = t.leastLoadedCron(key)
+		if insMgr == nil {
+			return nil, ErrPoolFull
+		}
+	}
+
+	if insMgr == nil {
+		insMgr = newCronManager(t.cronOpts, option...)
+		atomic.AddUint64(&t.dynamicCreated, 1)
+		insMgr.lastUsed = t.clock.Now()
+		t.dynamicCron = append(t.dynamicCron, insMgr)
+	}
+
+	return insMgr, nil
+
+}
+
+// taskOptions 返回任务实际使用的option WithDefaultOptions 设置的默认option在前 任务自己的option在后
+func (t *TaskTimer) taskOptions(option []cron.Option) []cron.Option {
+	if len(t.defaultOpts) == 0 {
+		return option
+	}
+	return append(append([]cron.Option{}, t.defaultOpts...), option...)
+}
+
+// pickCron 为新任务选择cron实例 没有option的高优先级任务使用 priorityCore 其他任务使用 getAliveCron
+func (t *TaskTimer) pickCron(priority Priority, option ...cron.Option) (*cronManager, error) {
+	if priority >= PriorityHigh && option == nil {
+		return t.priorityCore(), nil
+	}
+	return t.getAliveCron(option...)
+}
+
+// priorityCore 返回高优先级任务使用的核心cron 有空闲的核心cron时直接使用
+// 都忙碌时选择任务最少的核心cron 并尝试把其上一个普通优先级的任务迁移到动态cron
+// 没有可以迁移的任务或迁移失败时 高优先级任务仍然加入该核心cron 任务数会超过忙碌阈值
+func (t *TaskTimer) priorityCore() *cronManager {
+	if mgr := t.idleCore(); mgr != nil {
+		return mgr
+	}
+	core := t.coreCron[0]
+	if t.coreCron[1].entryCount() < core.entryCount() {
+		core = t.coreCron[1]
+	}
+	t.relocateOne(core)
+	return core
+}
+
+// relocateOne 把 core 上按名称排序的第一个普通优先级任务迁移到动态cron 迁移后 EntryID 会重新分配
+func (t *TaskTimer) relocateOne(core *cronManager) {
+	var names []string
+	for name, task := range t.taskList {
+		if task.cronManager == core && !task.paused && task.priority < PriorityHigh {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	sort.Strings(names)
+	mgr, err := t.getAliveCron()
+	if err != nil || mgr == core {
+		return
+	}
+	task := t.taskList[names[0]]
+	taskId, err := t.register(mgr, names[0], task)
+	if err != nil {
+		return
+	}
+	t.detach(task)
+	t.attach(mgr)
+	task.cronManager = mgr
+	task.EntryID = taskId
+	t.taskList[names[0]] = task
+}
+
+// idleCron 返回可以直接使用的空闲cron 没有option时优先使用核心cron 都不空闲时返回 nil
+func (t *TaskTimer) idleCron(key string, option ...cron.Option) *cronManager {
+	// 不存在option 找空闲核心cron
+	if option == nil {
+		if mgr := t.idleCore(); mgr != nil {
+			return mgr
+		}
+	}
+	// 如果没有空闲核心cron，查找option等价的动态cron
+	for _, mgr := range t.dynamicCron {
+		if mgr.checkIdle() && mgr.optKey == key {
+			return mgr
+		}
+	}
+	return nil
+}
+
+// idleCore 返回任务数最少的空闲核心cron 任务数相同时取下标小的 都忙碌时返回 nil
+func (t *TaskTimer) idleCore() *cronManager {
+	var (
+		insMgr *cronManager
+		least  int
+	)
+	for _, mgr := range t.coreCron {
+		if !mgr.checkIdle() {
+			continue
+		}
+		if count := mgr.entryCount(); insMgr == nil || count < least {
+			insMgr, least = mgr, count
+		}
+	}
+	return insMgr
+}
+
+// poolLimited 动态cron的数量是否已经达到上限
+func (t *TaskTimer) poolLimited() bool {
+	return t.maxDynamicCron > 0 && len(t.dynamicCron) >= t.maxDynamicCron
+}
+
+// dropUnused 注册失败后 为其新建的动态cron如果没有任何任务则立即停止并移出列表 不必等待空闲检查 与空闲检查一样调用回收回调
+// 暂停的任务可能仍引用该实例 恢复时会重新分配 调用方需持有 t.mu
+func (t *TaskTimer) dropUnused(mgr *cronManager) {
+	index := t.managerIndex(mgr) - len(t.coreCron)
+	if index < 0 || !mgr.isEmpty() {
+		return
+	}
+	t.dynamicCron = append(t.dynamicCron[:index], t.dynamicCron[index+1:]...)
+	t.reap(mgr)
+}
+
+// reap 停止动态cron并计数 调用 WithCronReapHandler 的回调并发出 EventReaped 不修改 dynamicCron
+// 调用方需持有 t.mu
+func (t *TaskTimer) reap(mgr *cronManager) {
+	mgr.Stop()
+	atomic.AddUint64(&t.dynamicReaped, 1)
+	if t.reapHandler != nil {
+		t.reapHandler(mgr.cronInst)
+	}
+	t.emit("", EventReaped)
+}
+
+// leastLoadedCron 在option等价的动态cron中 返回任务数最少的实例 忽略忙碌状态 没有时返回 nil
+func (t *TaskTimer) leastLoadedCron(key string) *cronManager {
+	var (
+		insMgr *cronManager
+		least  int
+	)
+	for _, mgr := range t.dynamicCron {
+		if mgr.optKey != key {
+			continue
+		}
+		if count := mgr.entryCount(); insMgr == nil || count < least {
+			insMgr, least = mgr, count
+		}
+	}
+	return insMgr
+}
+
+// AddTaskByFunc 通过函数的方法添加任务
+func (t *TaskTimer) AddTaskByFunc(taskName string, spec string, task func(), option ...cron.Option) (cron.EntryID, error) {
+	return t.addTask(taskName, spec, contextKey{job: cron.FuncJob(task)}, option...)
+}
+
+// AddTaskByFuncDetailed 与 AddTaskByFunc 相同 额外返回任务所在cron实例的下标 用于排查实例分配
+// 下标规则与 Distribution 一致 任务不存在时为 -1
+func (t *TaskTimer) AddTaskByFuncDetailed(taskName string, spec string, task func(), option ...cron.Option) (cron.EntryID, int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return 0, -1, ErrTimerClosed
+	}
+	taskId, err := t.addTaskLocked(taskName, spec, contextKey{job: cron.FuncJob(task)}, option...)
+	index := -1
+	if record, ok := t.taskList[taskName]; ok {
+		index = t.managerIndex(record.cronManager)
+	}
+	return taskId, index, err
+}
+
+// TryAddTaskByFunc 与 AddTaskByFunc 相同 但不会把任务加到忙碌的cron实例上
+// 没有空闲的cron实例且动态cron数量已达 WithMaxDynamicCrons 的上限时 直接返回 ErrPoolSaturated
+func (t *TaskTimer) TryAddTaskByFunc(taskName string, spec string, task func(), option ...cron.Option) (cron.EntryID, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return 0, ErrTimerClosed
+	}
+	opts := t.taskOptions(option)
+	if _, ok := t.taskList[taskName]; !ok && t.poolLimited() && t.idleCron(optionKey(opts...), opts...) == nil {
+		return 0, ErrPoolSaturated
+	}
+	return t.addTaskLocked(taskName, spec, contextKey{job: cron.FuncJob(task)}, option...)
+}
+
+// AddTaskByFuncContext 通过带上下文的函数添加任务
+// 上下文由 TaskTimer 持有 任务被 Remove 或 Close 时取消
+func (t *TaskTimer) AddTaskByFuncContext(taskName string, spec string, task func(context.Context), option ...cron.Option) (cron.EntryID, error) {
+	ctx, cancel := context.WithCancel(t.baseCtx)
+	job := cron.FuncJob(func() {
+		task(ctx)
+	})
+	return t.addTask(taskName, spec, contextKey{job: job, cancel: cancel}, option...)
+}
+
+// AddTaskByFuncContextTimeout 与 AddTaskByFuncContext 相同 每次执行的上下文在 timeout 后取消
+// 执行超时记录为 ErrTaskTimeout 可以通过 LastResult 查询 timeout<=0 时不设置超时
+// 默认超时后仍等待任务返回 设置 WithDetachOnTimeout 时不再等待
+func (t *TaskTimer) AddTaskByFuncContextTimeout(taskName string, spec string, task func(context.Context), timeout time.Duration, option ...cron.Option) (cron.EntryID, error) {
+	ctx, cancel := context.WithCancel(t.baseCtx)
+	state := &taskState{}
+	job := cron.FuncJob(func() {
+		if timeout <= 0 {
+			task(ctx)
+			state.setResult(t.clock.Now(), nil)
+			return
+		}
+		runCtx, runCancel := context.WithTimeout(ctx, timeout)
+		defer runCancel()
+		if t.detachTimeout {
+			state.setResult(t.clock.Now(), t.runDetachable(runCtx, task, state))
+			return
+		}
+		task(runCtx)
+		var err error
+		if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+			err = ErrTaskTimeout
+		}
+		state.setResult(t.clock.Now(), err)
+	})
+	return t.addTask(taskName, spec, contextKey{job: job, cancel: cancel, state: state}, option...)
+}
+
+// runDetachable 在新协程中执行任务 超时时不再等待 返回 ErrTaskTimeout 任务在分离的协程中继续执行
+// 任务完成和超时分离通过 CAS 决定先后 任务的panic在未分离时由当前协程重新抛出 分离后单独处理
+func (t *TaskTimer) runDetachable(ctx context.Context, task func(context.Context), state *taskState) error {
+	const (
+		pending int32 = iota
+		finished
+		detached
+	)
+	var (
+		status int32
+		done   = make(chan interface{}, 1) // 任务panic的值 正常返回时为 nil
+	)
+	go func() {
+		defer func() {
+			r := recover()
+			if atomic.CompareAndSwapInt32(&status, pending, finished) {
+				done <- r
+				return
+			}
+			if r != nil {
+				t.detachedPanic(state.taskName(), r)
+			}
+		}()
+		task(ctx)
+	}()
+	select {
+	case r := <-done:
+		if r != nil {
+			panic(r)
+		}
+		return nil
+	case <-ctx.Done():
+	}
+	// 父上下文取消(Remove/Close)时不分离 仍然等待任务返回
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) && atomic.CompareAndSwapInt32(&status, pending, detached) {
+		state.markDetached()
+		return ErrTaskTimeout
+	}
+	if r := <-done; r != nil {
+		panic(r)
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrTaskTimeout
+	}
+	return nil
+}
+
+// detachedPanic 处理分离后任务的panic 此时已经不在 wrapJob 的包装之内
+func (t *TaskTimer) detachedPanic(taskName string, recovered interface{}) {
+	if t.panicHandler != nil {
+		t.panicHandler(taskName, recovered)
+		return
+	}
+	t.logger.Error(fmt.Errorf("任务panic: %v", recovered), "分离的任务panic", "task", taskName)
+}
+
+// AddTaskByFuncWithResult 添加返回错误的任务 每次执行的结果可以通过 LastResult 查询
+func (t *TaskTimer) AddTaskByFuncWithResult(taskName string, spec string, task func() error, option ...cron.Option) (cron.EntryID, error) {
+	state := &taskState{}
+	job := cron.FuncJob(func() {
+		err := t.runWithRetry(task)
+		state.setResult(t.clock.Now(), err)
+	})
+	return t.addTask(taskName, spec, contextKey{job: job, state: state}, option...)
+}
+
+// runWithRetry 执行任务 失败时按 WithRetry 的配置重试 返回最后一次的错误
+func (t *TaskTimer) runWithRetry(task func() error) error {
+	err := task()
+	for attempt := 1; err != nil && attempt < t.retryAttempts; attempt++ {
+		time.Sleep(t.retryBackoff)
+		err = task()
+	}
+	return err
+}
+
+// AddTaskWithLabels 添加带标签的任务 可以通过 ListByLabel/RemoveByLabel 按标签分组操作
+func (t *TaskTimer) AddTaskWithLabels(taskName string, spec string, task func(), labels ...string) (cron.EntryID, error) {
+	return t.addTask(taskName, spec, contextKey{job: cron.FuncJob(task), labels: append([]string(nil), labels...)})
+}
+
+// AddTaskWithPolicy 按指定的重叠策略添加任务
+func (t *TaskTimer) AddTaskWithPolicy(taskName string, spec string, task func(), policy OverlapPolicy) (cron.EntryID, error) {
+	var job cron.Job = cron.FuncJob(task)
+	switch policy {
+	case OverlapSkip:
+		job = cron.SkipIfStillRunning(t.logger)(job)
+	case OverlapDelay:
+		job = cron.DelayIfStillRunning(t.logger)(job)
+	}
+	return t.addTask(taskName, spec, contextKey{job: job})
+}
+
+// AddTaskWithPriority 按优先级添加任务 PriorityHigh 的任务总是分配到核心cron
+// 核心cron都忙碌时 会把任务最少的核心cron上按名称排序的第一个普通优先级任务迁移到动态cron 被迁移的任务会分配新的 EntryID
+func (t *TaskTimer) AddTaskWithPriority(taskName string, spec string, task func(), priority Priority) (cron.EntryID, error) {
+	return t.addTask(taskName, spec, contextKey{job: cron.FuncJob(task), priority: priority})
+}
+
+// AddTaskWithWrappers 添加只对该任务生效的 cron.JobWrapper 例如 cron.SkipIfStillRunning 不影响其他任务
+// 包装后的任务保存在任务记录中 Pause/Resume UpdateSchedule 后仍然生效 ReplaceFunc 替换后不再包装
+func (t *TaskTimer) AddTaskWithWrappers(taskName string, spec string, task func(), wrappers ...cron.JobWrapper) (cron.EntryID, error) {
+	job := cron.NewChain(wrappers...).Then(cron.FuncJob(task))
+	return t.addTask(taskName, spec, contextKey{job: job})
+}
+
+// AddTaskInLocation 按指定时区添加任务 不同时区的任务会分配到不同的cron实例
+func (t *TaskTimer) AddTaskInLocation(taskName string, spec string, task func(), loc *time.Location) error {
+	if loc == nil {
+		return ErrNilLocation
+	}
+	_, err := t.AddTaskByFunc(taskName, spec, task, cron.WithLocation(loc))
+	return err
+}
+
+// AddTaskInTZ 按时区名添加任务 例如 "Asia/Shanghai" 其余行为与 AddTaskInLocation 相同
+// 时区名无效时直接返回包装了 time.LoadLocation 错误的 *TaskError 不会分配cron实例
+func (t *TaskTimer) AddTaskInTZ(taskName string, spec string, task func(), tzName string) error {
+	loc, err := time.LoadLocation(tzName)
+	if err != nil {
+		return &TaskError{Name: taskName, Op: "add", Err: err}
+	}
+	return t.AddTaskInLocation(taskName, spec, task, loc)
+}
+
+// AddTaskInWindow 添加只在每天 [start, end) 时间段内执行的任务 start 和 end 为距离当天0点的时间 例如 9*time.Hour
+// 触发时不在时间段内则跳过本次 start 大于 end 时表示跨越0点的时间段 时间段按任务的时区计算
+// 通过 option 传入 cron.WithLocation 时使用该时区 否则使用cron实例的默认时区(通常为本地时区)
+func (t *TaskTimer) AddTaskInWindow(taskName string, spec string, task func(), start, end time.Duration, option ...cron.Option) error {
+	loc := cron.New(append(append([]cron.Option{}, t.cronOpts...), t.taskOptions(option)...)...).Location()
+	job := func() {
+		if inWindow(t.clock.Now().In(loc), start, end) {
+			task()
+		}
+	}
+	_, err := t.AddTaskByFunc(taskName, spec, job, option...)
+	return err
+}
+
+// inWindow now 是否在当天的 [start, end) 时间段内 start 大于 end 时时间段跨越0点
+func inWindow(now time.Time, start, end time.Duration) bool {
+	y, m, d := now.Date()
+	offset := now.Sub(time.Date(y, m, d, 0, 0, 0, 0, now.Location()))
+	if start <= end {
+		return offset >= start && offset < end
+	}
+	return offset >= start || offset < end
+}
+
+// OnceTask 一次性任务 只执行一次 执行完成之后 就会被移除
+// spec 与 AddTaskByFunc 使用相同的解析规则 配置了 WithSecondsPrecision 或传入 cron.WithSeconds() 时支持6段spec
+// 移除在新协程中进行 移除前即使按秒再次触发也不会重复执行
+func (t *TaskTimer) OnceTask(taskName string, spec string, task func(), option ...cron.Option) (cron.EntryID,
+	error) {
+	state := &taskState{}
+	newTask := t.onceWrapper(taskName, task, state)
+	return t.addOnceTask(taskName, spec, contextKey{job: cron.FuncJob(newTask), state: state, once: true}, option...)
+}
+
+// AddTaskAfter 添加在 d 之后执行一次的任务 执行完成之后 就会被移除
+// d<=0 时任务会尽快执行 任务没有spec SpecOf 返回空字符串
+func (t *TaskTimer) AddTaskAfter(taskName string, d time.Duration, task func()) error {
+	return t.addOnceAt(taskName, time.Now().Add(d), task)
+}
+
+// AddTaskAt 添加在 at 时刻执行一次的任务 执行完成之后 就会被移除
+// at 已经过去时返回 ErrTimeInPast 任务没有spec SpecOf 返回空字符串
+func (t *TaskTimer) AddTaskAt(taskName string, at time.Time, task func()) error {
+	if !at.After(time.Now()) {
+		return ErrTimeInPast
+	}
+	return t.addOnceAt(taskName, at, task)
+}
+
+// RunOnceNow 立即在新协程中执行一次任务 执行期间任务记录在任务列表中 可以通过 FindTask/IsRunning 查询 执行完成后自动移除
+// 不需要spec 也不会添加cron条目 不占用cron实例的容量 同名任务已存在时返回 ErrTaskExists
+// 任务没有执行计划 Pause/Resume/UpdateSchedule/ReplaceFunc 返回 ErrNotScheduled Close 会等待任务执行完成
+func (t *TaskTimer) RunOnceNow(taskName string, task func()) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrTimerClosed
+	}
+	if _, ok := t.taskList[taskName]; ok {
+		return ErrTaskExists
+	}
+	if t.nameValidator != nil {
+		if err := t.nameValidator(taskName); err != nil {
+			return &TaskError{Name: taskName, Op: "add", Err: err}
+		}
+	}
+	state := &taskState{historySize: t.historySize}
+	record := contextKey{
+		cronManager: t.directMgr,
+		job:         t.applyMiddleware(cron.FuncJob(task)),
+		state:       state,
+		once:        true,
+		direct:      true,
+	}
+	t.taskList[taskName] = record
+	job := t.wrapJob(taskName, record.job, state)
+	t.directWg.Add(1)
+	go func() {
+		defer t.directWg.Done()
+		defer t.removeByState(taskName, state) // 任务panic时同样会移除
+		job.Run()
+	}()
+	t.emit(taskName, EventAdded)
+	return nil
+}
+
+// addOnceAt 添加在 at 时刻执行一次的任务 at 已经过去时尽快执行
+func (t *TaskTimer) addOnceAt(taskName string, at time.Time, task func()) error {
+	state := &taskState{}
+	newTask := t.onceWrapper(taskName, task, state)
+	schedule := &onceSchedule{at: at}
+	_, err := t.addOnceTask(taskName, "", contextKey{job: cron.FuncJob(newTask), schedule: schedule, state: state, once: true})
+	return err
+}
+
+// addOnceTask 添加一次性任务 同名任务已经存在时按 WithOnceDuplicatePolicy 的策略处理
+func (t *TaskTimer) addOnceTask(taskName string, spec string, task contextKey, option ...cron.Option) (cron.EntryID, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return 0, ErrTimerClosed
+	}
+	if old, ok := t.taskList[taskName]; ok {
+		switch t.oncePolicy {
+		case OnceIgnore:
+			return old.EntryID, nil
+		case OnceReplace:
+			// 先移出旧任务的记录以便添加同名任务 添加失败时恢复 成功后再释放旧任务
+			delete(t.taskList, taskName)
+			taskId, err := t.addTaskLocked(taskName, spec, task, option...)
+			if err != nil {
+				t.taskList[taskName] = old
+				return 0, err
+			}
+			t.discardLocked(old)
+			return taskId, nil
+		}
+	}
+	return t.addTaskLocked(taskName, spec, task, option...)
+}
+
+// onceWrapper 对提供的func 进行包装 只执行一次 执行完成后在新协程中移除 不阻塞cron的工作协程
+// 任务记录需要使用同一个 state 移除时按 state 查找任务 重新注册(UpdateSchedule/Resume 等)后 EntryID 变化同样可以移除
+// 同名的新任务使用新的 state 不会被误删
+func (t *TaskTimer) onceWrapper(taskName string, task func(), state *taskState) func() {
+	var once sync.Once
+	newTask := func() {
+		once.Do(func() {
+			// 使用 defer 保证任务panic时同样会移除 panic继续向上抛出 由 WithPanicHandler 处理
+			defer func() {
+				go t.removeByState(taskName, state)
+			}()
+			task()
+		})
+	}
+	return newTask
+}
+
+// replacementJob 返回替换执行函数后的执行内容 一次性任务使用原来的 state 重新包装 仍然只执行一次并在执行后移除
+// 调用方需持有 t.mu
+func (t *TaskTimer) replacementJob(taskName string, old contextKey, task func()) cron.Job {
+	if old.once {
+		task = t.onceWrapper(taskName, task, old.state)
+	}
+	return t.applyMiddleware(cron.FuncJob(task))
+}
+
+// onceSchedule 只触发一次的执行计划 第一次计算时返回 at(已经过去则立即执行) 之后返回零值表示不再执行
+type onceSchedule struct {
+	at   time.Time
+	used int32
+}
+
+func (s *onceSchedule) Next(t time.Time) time.Time {
+	if !atomic.CompareAndSwapInt32(&s.used, 0, 1) {
+		return time.Time{}
+	}
+	if s.at.Before(t) {
+		return t
+	}
+	return s.at
+}
+
+// AddDependentTask 添加依赖其他任务的任务 按 spec 触发时 只有 dependsOn 最近一次执行成功才会执行 否则跳过本次
+// dependsOn 从未执行过 执行失败(返回错误或panic) 或已被删除时都会跳过 添加时 dependsOn 必须存在 否则返回 ErrTaskNotFound
+// 依赖按任务本身记录 dependsOn 通过 Rename 改名后依赖仍然有效 删除后重新添加的同名任务同样视为依赖
+// 只支持单个依赖 不会在 dependsOn 执行后立即触发
+func (t *TaskTimer) AddDependentTask(taskName string, dependsOn string, spec string, task func()) error {
+	t.mu.Lock()
+	parent, ok := t.taskList[dependsOn]
+	t.mu.Unlock()
+	if !ok {
+		return ErrTaskNotFound
+	}
+	parentState := parent.state
+	job := cron.FuncJob(func() {
+		t.mu.Lock()
+		state := parentState
+		if _, found := t.nameOfStateLocked(parentState, dependsOn); !found {
+			// 原来的任务已被删除 使用同名的新任务
+			current, ok := t.taskList[dependsOn]
+			if !ok {
+				t.mu.Unlock()
+				return
+			}
+			state = current.state
+		}
+		t.mu.Unlock()
+		if !state.succeeded() {
+			return
+		}
+		task()
+	})
+	_, err := t.addTask(taskName, spec, contextKey{job: job})
+	return err
+}
+
+// AddTaskBySchedule 使用已经解析好的执行计划添加任务 例如通过 cron.ParseStandard 解析一次后重复使用
+// 不会解析spec 因此不受 WithSecondsPrecision/WithParser 的影响 任务同样参与cron实例的分配和状态统计
+// 任务没有spec SpecOf 返回空字符串 ExportTasks 不会导出该任务
+func (t *TaskTimer) AddTaskBySchedule(taskName string, schedule cron.Schedule, task func()) error {
+	if schedule == nil {
+		return ErrNilSchedule
+	}
+	_, err := t.addTask(taskName, "", contextKey{job: cron.FuncJob(task), schedule: schedule})
+	return err
+}
+
+// AddTaskByJob 通过接口的方法添加任务
+func (t *TaskTimer) AddTaskByJob(taskName string, spec string, job interface{ Run() }, option ...cron.Option) (cron.EntryID, error) {
+	return t.addTask(taskName, spec, contextKey{job: job}, option...)
+}
+
+// AddJobAuto 通过接口添加任务 任务名由 job 的 Name() string 方法提供
+// job 没有实现 Name 或返回空字符串时返回 ErrJobNoName
+func (t *TaskTimer) AddJobAuto(spec string, job interface{ Run() }, option ...cron.Option) (cron.EntryID, error) {
+	named, ok := job.(interface{ Name() string })
+	if !ok || named.Name() == "" {
+		return 0, ErrJobNoName
+	}
+	return t.AddTaskByJob(named.Name(), spec, job, option...)
+}
+
+// AddTaskByJobContext 通过带上下文的接口添加任务
+// 上下文由 TaskTimer 持有 任务被 Remove 或 Close 时取消
+func (t *TaskTimer) AddTaskByJobContext(taskName string, spec string, job interface{ Run(context.Context) }, option ...cron.Option) (cron.EntryID, error) {
+	ctx, cancel := context.WithCancel(t.baseCtx)
+	ctxJob := cron.FuncJob(func() {
+		job.Run(ctx)
+	})
+	return t.addTask(taskName, spec, contextKey{job: ctxJob, cancel: cancel}, option...)
+}
+
+// addTask 添加任务的公共逻辑 task 中的 job 会保存在任务记录中 便于重新注册
+// 添加失败时会调用 task.cancel 释放上下文
+func (t *TaskTimer) addTask(taskName string, spec string, task contextKey, option ...cron.Option) (cron.EntryID, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		task.cancelCtx()
+		return 0, ErrTimerClosed
+	}
+	return t.addTaskLocked(taskName, spec, task, option...)
+}
+
+// addTaskLocked 与 addTask 相同 调用方需持有 t.mu
+func (t *TaskTimer) addTaskLocked(taskName string, spec string, task contextKey, option ...cron.Option) (cron.EntryID, error) {
+	if t.nameValidator != nil {
+		if err := t.nameValidator(taskName); err != nil {
+			task.cancelCtx()
+			return 0, &TaskError{Name: taskName, Op: "add", Err: err}
+		}
+	}
+	_, ok := t.taskList[taskName]
+	if !ok {
+		option = t.taskOptions(option)
+		mgr, err := t.pickCron(task.priority, option...)
+		if err != nil {
+			task.cancelCtx()
+			return 0, err
+		}
+		task.spec = spec
+		task.job = t.applyMiddleware(task.job)
+		if task.state == nil {
+			task.state = &taskState{}
+		}
+		task.state.historySize = t.historySize
+		if t.validateReachability && task.schedule == nil {
+			err = mgr.checkReachable(spec, t.clock.Now())
+		}
+		var taskId cron.EntryID
+		if err == nil {
+			taskId, err = t.register(mgr, taskName, task)
+		}
+		if err != nil {
+			task.cancelCtx()
+			t.dropUnused(mgr)
+			return 0, &TaskError{Name: taskName, Op: "add", Err: err}
+		}
+		task.cronManager = mgr
+		task.EntryID = taskId
+		t.taskList[taskName] = task
+		t.attach(mgr)
+		t.emit(taskName, EventAdded)
+		return taskId, nil
+	}
+	task.cancelCtx()
+	return t.taskList[taskName].EntryID, ErrTaskExists
+}
+
+// Use 注册全局中间件 添加任务时按注册顺序包装任务 先注册的在最外层 最先执行
+// 中间件只对之后添加(或 ReplaceFunc 替换)的任务生效 已经添加的任务不受影响
+func (t *TaskTimer) Use(middleware ...func(next func()) func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.middlewares = append(t.middlewares, middleware...)
+}
+
+// applyMiddleware 使用当前的全局中间件包装任务 调用方需持有 t.mu
+func (t *TaskTimer) applyMiddleware(job cron.Job) cron.Job {
+	if len(t.middlewares) == 0 {
+		return job
+	}
+	next := job.Run
+	for i := len(t.middlewares) - 1; i >= 0; i-- {
+		next = t.middlewares[i](next)
+	}
+	return cron.FuncJob(next)
+}
+
+// register 将任务注册到 mgr 上 返回新的 EntryID 调用方需持有 t.mu
+// 任务带有 schedule 时直接使用 schedule 不解析spec
+func (t *TaskTimer) register(mgr *cronManager, taskName string, task contextKey) (cron.EntryID, error) {
+	job := t.wrapJob(taskName, task.job, task.state)
+	if task.schedule != nil {
+		schedule := task.schedule
+		if s, ok := schedule.(*onceSchedule); ok { // 每次注册重新计算 保证仍会执行一次
+			schedule = &onceSchedule{at: s.at}
+		}
+		return mgr.cronInst.Schedule(schedule, job), nil
+	}
+	return mgr.cronInst.AddJob(task.spec, job)
+}
+
+// wrapJob 为任务附加统一的包装逻辑 注册到cron的都是包装后的任务 任务记录中保存原始任务
+// 最内层记录任务是否正在执行以及执行统计 供 IsRunning 和 Stats 查询 panic被恢复之前就能记录失败
+// 上报的任务名每次执行时从 state 读取 Rename 之后立即生效
+func (t *TaskTimer) wrapJob(taskName string, job cron.Job, state *taskState) cron.Job {
+	state.setName(taskName)
+	job = state.track(job, t.clock)
+	if t.metrics != nil {
+		job = metricsJob(state, job, t.metrics)
+	}
+	if t.panicHandler != nil {
+		job = recoverJob(state, job, t.panicHandler)
+	}
+	if t.beforeRun != nil || t.afterRun != nil {
+		job = hookJob(state, job, t.beforeRun, t.afterRun)
+	}
+	if t.pool != nil {
+		job = t.pool.wrap(job)
+	}
+	if t.jitter > 0 { // 在放入队列之前等待 不占用执行任务的协程
+		job = jitterJob(job, t.jitter)
+	}
+	return job
+}
+
+// jitterJob 每次执行前随机等待 [0, max] 的时间 等待期间不计入执行统计
+func jitterJob(job cron.Job, max time.Duration) cron.Job {
+	return cron.FuncJob(func() {
+		time.Sleep(time.Duration(rand.Int63n(int64(max) + 1)))
+		job.Run()
+	})
+}
+
+// metricsJob 统计任务的执行耗时 任务panic时记录错误后继续向上抛出
+func metricsJob(state *taskState, job cron.Job, recorder MetricsRecorder) cron.Job {
+	return cron.FuncJob(func() {
+		start := time.Now()
+		defer func() {
+			var err error
+			r := recover()
+			if r != nil {
+				err = fmt.Errorf("任务panic: %v", r)
+			}
+			recorder.ObserveRun(state.taskName(), time.Since(start), err)
+			if r != nil {
+				panic(r)
+			}
+		}()
+		job.Run()
+	})
+}
+
+// recoverJob 拦截任务的panic 交给 handler 处理
+func recoverJob(state *taskState, job cron.Job, handler func(taskName string, recovered interface{})) cron.Job {
+	return cron.FuncJob(func() {
+		defer func() {
+			if r := recover(); r != nil {
+				handler(state.taskName(), r)
+			}
+		}()
+		job.Run()
+	})
+}
+
+// hookJob 在任务执行前后调用回调 未设置的回调不调用
+func hookJob(state *taskState, job cron.Job, before func(taskName string), after func(taskName string, d time.Duration)) cron.Job {
+	return cron.FuncJob(func() {
+		taskName := state.taskName()
+		if before != nil {
+			before(taskName)
+		}
+		if after != nil {
+			start := time.Now()
+			defer func() {
+				after(taskName, time.Since(start))
+			}()
+		}
+		job.Run()
+	})
+}
+
+// workerPool 固定数量的协程从队列中取出任务执行
+type workerPool struct {
+	queue  chan func()
+	mu     sync.RWMutex // 保护closed 发送时持有读锁 保证不会向已关闭的队列发送
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newWorkerPool(size int) *workerPool {
+	p := &workerPool{queue: make(chan func(), size)}
+	p.wg.Add(size)
+	for i := 0; i < size; i++ {
+		go func() {
+			defer p.wg.Done()
+			for fn := range p.queue {
+				fn()
+			}
+		}()
+	}
+	return p
+}
+
+// wrap 包装任务 执行时放入队列 队列已满时阻塞 关闭之后直接在当前协程执行
+func (p *workerPool) wrap(job cron.Job) cron.Job {
+	return cron.FuncJob(func() {
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		if p.closed {
+			job.Run()
+			return
+		}
+		p.queue <- job.Run
+	})
+}
+
+// stop 关闭队列 返回的context在队列中的任务全部执行完成后关闭
+func (p *workerPool) stop() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		p.mu.Lock()
+		p.closed = true
+		close(p.queue)
+		p.mu.Unlock()
+		p.wg.Wait()
+		cancel()
+	}()
+	return ctx
+}
+
+// UpsertTaskByFunc 添加或替换任务 同名任务存在时替换其执行计划和执行函数 不存在时添加
+// 替换时先注册新的条目再移除旧条目 任务不会中断 失败时原任务不受影响 一次性任务替换后仍然只执行一次
+func (t *TaskTimer) UpsertTaskByFunc(taskName string, spec string, task func(), option ...cron.Option) (cron.EntryID, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return 0, ErrTimerClosed
+	}
+	return t.upsertLocked(taskName, spec, task, option...)
+}
+
+// upsertLocked 与 UpsertTaskByFunc 相同 调用方需持有 t.mu
+func (t *TaskTimer) upsertLocked(taskName string, spec string, task func(), option ...cron.Option) (cron.EntryID, error) {
+	old, replaced, taskId, err := t.swapLocked(taskName, spec, task, option...)
+	if err == nil && replaced {
+		old.cancelCtx()
+	}
+	return taskId, err
+}
+
+// swapLocked 与 upsertLocked 相同 但不取消被替换任务的上下文 replaced 为 true 时返回被替换的任务记录
+// 调用方在确认不再需要回滚后负责取消 调用方需持有 t.mu
+func (t *TaskTimer) swapLocked(taskName string, spec string, task func(), option ...cron.Option) (old contextKey, replaced bool, taskId cron.EntryID, err error) {
+	old, ok := t.taskList[taskName]
+	if !ok {
+		taskId, err = t.addTaskLocked(taskName, spec, contextKey{job: cron.FuncJob(task)}, option...)
+		return contextKey{}, false, taskId, err
+	}
+	if old.direct {
+		return contextKey{}, false, 0, ErrNotScheduled
+	}
+	updated := old
+	updated.spec = spec
+	updated.schedule = nil
+	updated.job = t.replacementJob(taskName, old, task)
+	updated.cancel = nil
+	option = t.taskOptions(option)
+	if optionKey(option...) == old.optKey {
+		if err = t.replaceEntry(taskName, old, updated); err != nil {
+			return contextKey{}, false, 0, err
+		}
+	} else {
+		// option不同时需要迁移到对应的cron实例
+		mgr, err := t.getAliveCron(option...)
+		if err != nil {
+			return contextKey{}, false, 0, err
+		}
+		updated.cronManager = mgr
+		if old.paused {
+			if err = mgr.validSpec(spec); err != nil {
+				t.dropUnused(mgr)
+				return contextKey{}, false, 0, err
+			}
+		} else {
+			if updated.EntryID, err = t.register(mgr, taskName, updated); err != nil {
+				t.dropUnused(mgr)
+				return contextKey{}, false, 0, err
+			}
+			t.detach(old)
+			t.attach(mgr)
+		}
+		t.taskList[taskName] = updated
+	}
+	return old, true, t.taskList[taskName].EntryID, nil
+}
+
+// restoreLocked 撤销 swapLocked 的替换 移除新的条目 恢复原来的任务记录并重新注册 返回新条目所在的cron实例
+// 该实例可能因此变空 由调用方在全部撤销完成后通过 dropUnused 回收 调用方需持有 t.mu
+func (t *TaskTimer) restoreLocked(taskName string, old contextKey) *cronManager {
+	current := t.taskList[taskName]
+	if !current.paused {
+		t.detach(current)
+	}
+	t.reinstateLocked(taskName, old)
+	return current.cronManager
+}
+
+// reinstateLocked 把移出的任务记录放回 taskList 未暂停的任务重新注册到原来的cron实例 EntryID 会重新分配
+// 调用方需持有 t.mu
+func (t *TaskTimer) reinstateLocked(taskName string, old contextKey) {
+	if !old.paused {
+		// 原来的任务注册成功过 重新注册不会失败
+		if taskId, err := t.register(old.cronManager, taskName, old); err == nil {
+			old.EntryID = taskId
+			t.attach(old.cronManager)
+		}
+	}
+	t.taskList[taskName] = old
+}
+
+// TaskDef ApplySet 使用的任务定义
+type TaskDef struct {
+	Name    string
+	Spec    string
+	Func    func()
+	Options []cron.Option
+}
+
+// ApplySet 在同一次加锁内把任务集合调整为 desired 删除不在 desired 中的任务 添加新任务 更新spec或option变化的任务
+// spec和option都没有变化的任务保持不变 不替换执行函数 应用之前会先校验所有spec 校验失败时不做任何修改
+// 应用过程中出错(例如 ErrPoolFull 或任务名校验失败)时回滚已经完成的删除 添加和更新 任务集合恢复为调用前的状态
+// 此时返回的数量均为0 回滚后重新注册的任务 EntryID 会重新分配 被删除和被替换的任务在全部成功后才取消上下文
+func (t *TaskTimer) ApplySet(desired []TaskDef) (added, removed, updated int, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return 0, 0, 0, ErrTimerClosed
+	}
+
+	wanted := make(map[string]bool, len(desired))
+	for _, def := range desired {
+		if wanted[def.Name] {
+			return 0, 0, 0, &TaskError{Name: def.Name, Op: "apply", Err: ErrTaskExists}
+		}
+		wanted[def.Name] = true
+		if err := parseSpec(def.Spec, append(append([]cron.Option{}, t.cronOpts...), t.taskOptions(def.Options)...)...); err != nil {
+			return 0, 0, 0, &TaskError{Name: def.Name, Op: "apply", Err: err}
+		}
+	}
+
+	// 先从cron和 taskList 中移出多余的任务 暂不取消上下文 出错时可以原样恢复
+	var gone []string
+	for name := range t.taskList {
+		if !wanted[name] {
+			gone = append(gone, name)
+		}
+	}
+	sort.Strings(gone)
+	removedTasks := make([]contextKey, 0, len(gone))
+	for _, name := range gone {
+		task := t.taskList[name]
+		if !task.paused {
+			t.detach(task)
+		}
+		delete(t.taskList, name)
+		removedTasks = append(removedTasks, task)
+	}
+
+	var (
+		applied  []string                  // 按应用顺序记录的任务名 回滚时倒序撤销
+		replaced = map[string]contextKey{} // 被更新的任务原来的记录
+	)
+	for _, def := range desired {
+		old, ok := t.taskList[def.Name]
+		if ok && old.schedule == nil && old.spec == def.Spec && old.optKey == optionKey(t.taskOptions(def.Options)...) {
+			continue
+		}
+		prev, swapped, _, err := t.swapLocked(def.Name, def.Spec, def.Func, def.Options...)
+		if err != nil {
+			// 倒序撤销 被删除的任务恢复之后再回收变空的cron实例 避免恢复到已经停止的实例上
+			var unused []*cronManager
+			for i := len(applied) - 1; i >= 0; i-- {
+				name := applied[i]
+				if prev, ok := replaced[name]; ok {
+					unused = append(unused, t.restoreLocked(name, prev))
+					continue
+				}
+				unused = append(unused, t.taskList[name].cronManager)
+				t.removeLocked(name)
+			}
+			for i, name := range gone {
+				t.reinstateLocked(name, removedTasks[i])
+			}
+			for _, mgr := range unused {
+				t.dropUnused(mgr)
+			}
+			return 0, 0, 0, err
+		}
+		applied = append(applied, def.Name)
+		if swapped {
+			replaced[def.Name] = prev
+		}
+	}
+
+	for i, name := range gone {
+		task := removedTasks[i]
+		task.cancelCtx()
+		task.state.stopDebounce()
+		t.emit(name, EventRemoved)
+	}
+	for _, prev := range replaced {
+		prev.cancelCtx()
+	}
+	return len(applied) - len(replaced), len(gone), len(replaced), nil
+}
+
+// UpdateSchedule 修改任务的执行计划 任务名和执行内容保持不变
+// 新的spec解析失败时 原任务不受影响
+func (t *TaskTimer) UpdateSchedule(taskName string, newSpec string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrTimerClosed
+	}
+	task, ok := t.taskList[taskName]
+	if !ok {
+		return ErrTaskNotFound
+	}
+	if task.direct {
+		return ErrNotScheduled
+	}
+	updated := task
+	updated.spec = newSpec
+	updated.schedule = nil
+	return t.replaceEntry(taskName, task, updated)
+}
+
+// ReplaceFunc 替换任务的执行函数 执行计划保持不变
+// 一次性任务替换后仍然只执行一次 执行后移除
+// 原任务如果带有上下文 替换成功后上下文会被取消
+func (t *TaskTimer) ReplaceFunc(taskName string, task func()) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrTimerClosed
+	}
+	old, ok := t.taskList[taskName]
+	if !ok {
+		return ErrTaskNotFound
+	}
+	if old.direct {
+		return ErrNotScheduled
+	}
+	updated := old
+	updated.job = t.replacementJob(taskName, old, task)
+	updated.cancel = nil
+	if err := t.replaceEntry(taskName, old, updated); err != nil {
+		return err
+	}
+	old.cancelCtx()
+	return nil
+}
+
+// replaceEntry 使用 updated 中新的执行计划和执行内容重新注册任务 调用方需持有 t.mu
+// 先注册新的条目 成功之后再移除旧条目 保证任务不会中断 失败时原任务不受影响
+func (t *TaskTimer) replaceEntry(taskName string, old contextKey, updated contextKey) error {
+	if old.paused {
+		// 暂停中的任务只校验并记录 恢复时再注册
+		if updated.schedule == nil {
+			if err := old.validSpec(updated.spec); err != nil {
+				return err
+			}
+		}
+	} else {
+		taskId, err := t.register(old.cronManager, taskName, updated)
+		if err != nil {
+			return err
+		}
+		old.removeEntry(old.EntryID, t.busyThreshold, t.clock.Now())
+		updated.EntryID = taskId
+	}
+	t.taskList[taskName] = updated
+	return nil
+}
+
+// Rebalance 将动态cron上没有option的任务迁回空闲的核心cron 核心cron忙碌后停止迁移
+// 迁移后任务名不变 EntryID 会重新分配 被清空的动态cron由空闲检查回收
+func (t *TaskTimer) Rebalance() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrTimerClosed
+	}
+	names := make([]string, 0, len(t.taskList))
+	for name, task := range t.taskList {
+		if len(task.option) == 0 && t.managerIndex(task.cronManager) >= len(t.coreCron) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		core := t.idleCore()
+		if core == nil {
+			return nil
+		}
+		task := t.taskList[name]
+		if !task.paused {
+			taskId, err := t.register(core, name, task)
+			if err != nil {
+				return err
+			}
+			t.detach(task)
+			t.attach(core)
+			task.EntryID = taskId
+		}
+		task.cronManager = core
+		t.taskList[name] = task
+	}
+	return nil
+}
+
+// Rename 修改任务名 任务记录原样保留 EntryID 和执行计划不变 不会错过执行
+// oldName 不存在时返回 ErrTaskNotFound newName 已存在时返回 ErrTaskExists
+// 指标 panic处理和回调上报的任务名随之更新 之后的执行使用新的任务名
+// 依赖该任务的 AddDependentTask 任务按任务本身查找依赖 改名后依赖仍然有效
+func (t *TaskTimer) Rename(oldName, newName string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrTimerClosed
+	}
+	task, ok := t.taskList[oldName]
+	if !ok {
+		return ErrTaskNotFound
+	}
+	if _, exists := t.taskList[newName]; exists {
+		return ErrTaskExists
+	}
+	if t.nameValidator != nil {
+		if err := t.nameValidator(newName); err != nil {
+			return &TaskError{Name: newName, Op: "rename", Err: err}
+		}
+	}
+	delete(t.taskList, oldName)
+	t.taskList[newName] = task
+	task.state.setName(newName)
+	// WithDebounce 的防抖配置随任务一起移动
+	if window, ok := t.debounce[oldName]; ok {
+		delete(t.debounce, oldName)
+		t.debounce[newName] = window
+	}
+	return nil
+}
+
+// Pause 暂停任务 任务从cron中移除 但保留执行计划和执行内容 FindTask 仍返回 true
+// 暂停已经暂停的任务不做处理 返回 nil
+func (t *TaskTimer) Pause(taskName string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrTimerClosed
+	}
+	task, ok := t.taskList[taskName]
+	if !ok {
+		return ErrTaskNotFound
+	}
+	if task.direct {
+		return ErrNotScheduled
+	}
+	if task.paused {
+		return nil
+	}
+	t.detach(task)
+	task.EntryID = 0
+	task.paused = true
+	t.taskList[taskName] = task
+	t.emit(taskName, EventPaused)
+	return nil
+}
+
+// Resume 恢复暂停的任务 重新注册后会分配新的 EntryID
+// 恢复未暂停的任务不做处理 返回 nil
+func (t *TaskTimer) Resume(taskName string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrTimerClosed
+	}
+	task, ok := t.taskList[taskName]
+	if !ok {
+		return ErrTaskNotFound
+	}
+	if task.direct {
+		return ErrNotScheduled
+	}
+	if !task.paused {
+		return nil
+	}
+	mgr := task.cronManager
+	if mgr.getStatus() == RemovedStatus { // 暂停期间所在的cron实例可能已被回收
+		var err error
+		if mgr, err = t.getAliveCron(mgr.option...); err != nil {
+			return err
+		}
+	}
+	taskId, err := t.register(mgr, taskName, task)
+	if err != nil {
+		return err
+	}
+	task.cronManager = mgr
+	task.EntryID = taskId
+	task.paused = false
+	t.taskList[taskName] = task
+	t.attach(mgr)
+	t.emit(taskName, EventResumed)
+	return nil
+}
+
+// TaskDefinition 导出的任务定义 执行函数无法序列化 导入时通过 resolver 还原
+type TaskDefinition struct {
+	Name    string   `json:"name"`
+	Spec    string   `json:"spec"`
+	Labels  []string `json:"labels,omitempty"`
+	Options string   `json:"options,omitempty"` // option的描述 只能还原时区和解析器
+	Paused  bool     `json:"paused,omitempty"`
+	Once    bool     `json:"once,omitempty"` // 一次性任务 导入时仍然只执行一次
+}
+
+// ExportTasks 将任务定义导出为JSON 按任务名排序 没有spec的任务(如 AddTaskAfter RunOnceNow 添加的)不会导出
+func (t *TaskTimer) ExportTasks() ([]byte, error) {
+	t.mu.Lock()
+	defs := make([]TaskDefinition, 0, len(t.taskList))
+	for name, task := range t.taskList {
+		if task.schedule != nil || task.direct {
+			continue
+		}
+		defs = append(defs, TaskDefinition{
+			Name:    name,
+			Spec:    task.spec,
+			Labels:  task.labels,
+			Options: task.optKey,
+			Paused:  task.paused,
+			Once:    task.once,
+		})
+	}
+	t.mu.Unlock()
+	sort.Slice(defs, func(i, j int) bool {
+		return defs[i].Name < defs[j].Name
+	})
+	return json.Marshal(defs)
+}
+
+// ImportTasks 导入 ExportTasks 导出的任务定义 resolver 根据任务名返回执行函数
+// 已经存在的同名任务会被跳过 其余任务导入失败时继续导入 最后返回所有的错误
+// 一次性任务导入后仍然只执行一次 option 无法还原(例如 opaque#N 或自定义的解析器)的任务不会导入 作为错误返回
+func (t *TaskTimer) ImportTasks(data []byte, resolver func(name string) func()) error {
+	var defs []TaskDefinition
+	if err := json.Unmarshal(data, &defs); err != nil {
+		return err
+	}
+	var errs []error
+	for _, def := range defs {
+		task := resolver(def.Name)
+		if task == nil {
+			errs = append(errs, fmt.Errorf("任务 %s 没有对应的执行函数", def.Name))
+			continue
+		}
+		option, err := optionsFromKey(def.Options)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("任务 %s: %w", def.Name, err))
+			continue
+		}
+		record := contextKey{job: cron.FuncJob(task), labels: def.Labels}
+		if def.Once {
+			record.state = &taskState{}
+			record.job = cron.FuncJob(t.onceWrapper(def.Name, task, record.state))
+			record.once = true
+		}
+		if _, err = t.addTask(def.Name, def.Spec, record, option...); err != nil {
+			if !errors.Is(err, ErrTaskExists) {
+				errs = append(errs, fmt.Errorf("任务 %s: %w", def.Name, err))
+			}
+			continue
+		}
+		if def.Paused {
+			if err = t.Pause(def.Name); err != nil {
+				errs = append(errs, fmt.Errorf("任务 %s: %w", def.Name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Events 订阅任务的生命周期事件 每次调用返回一个新的订阅
+// 事件以非阻塞的方式发送 订阅者处理过慢导致缓冲区满时 新的事件会被丢弃 Close 时关闭所有订阅
+func (t *TaskTimer) Events() <-chan TaskEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ch := make(chan TaskEvent, eventBufferSize)
+	if t.closed {
+		close(ch)
+		return ch
+	}
+	t.subscribers = append(t.subscribers, ch)
+	return ch
+}
+
+// emit 向所有订阅者发送事件 不会阻塞 调用方需持有 t.mu
+func (t *TaskTimer) emit(taskName string, typ EventType) {
+	if len(t.subscribers) == 0 {
+		return
+	}
+	event := TaskEvent{TaskName: taskName, Type: typ, Time: t.clock.Now()}
+	for _, ch := range t.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// attach 任务加入cron实例后更新实例状态 调用方需持有 t.mu
+func (t *TaskTimer) attach(mgr *cronManager) {
+	if mgr.markAdded(t.busyThreshold, t.clock.Now()) && t.busyHandler != nil {
+		go t.busyHandler(t.managerIndex(mgr)) // 在新协程中回调 不阻塞添加任务 也不会在回调中死锁
+	}
+}
+
+// detach 将任务从所在的cron实例中移除并更新实例状态 调用方需持有 t.mu
+func (t *TaskTimer) detach(task contextKey) {
+	task.removeEntry(task.EntryID, t.busyThreshold, t.clock.Now())
+}
+
+// ValidateSpec 校验spec是否有效 不会添加任务 与添加任务时使用相同的解析规则(包括秒级精度配置)
+func (t *TaskTimer) ValidateSpec(spec string, option ...cron.Option) error {
+	return parseSpec(spec, append(append([]cron.Option{}, t.cronOpts...), t.taskOptions(option)...)...)
+}
+
+func (t *TaskTimer) FindTask(taskName string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.taskList[taskName]
+	return ok
+}
+
+// ListByLabel 返回所有带有 label 标签的任务名 按名称排序
+func (t *TaskTimer) ListByLabel(label string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	names := make([]string, 0)
+	for name, task := range t.taskList {
+		if task.hasLabel(label) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TaskState 返回任务的状态 RunningState 或 PausedState 任务不存在时返回 ErrTaskNotFound
+func (t *TaskTimer) TaskState(taskName string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	task, ok := t.taskList[taskName]
+	if !ok {
+		return "", ErrTaskNotFound
+	}
+	if task.paused {
+		return PausedState, nil
+	}
+	return RunningState, nil
 }
 
-func newCronManager(option ...cron.Option) *cronManager {
-	timerWorker := cron.New(option...)
-	timerWorker.Start()
-	return &cronManager{
-		cronInst: timerWorker,
-		status:   IdleStatus, // 初始状态为空闲
+// EntryIDOf 返回任务在cron中的 EntryID 暂停的任务返回 0
+func (t *TaskTimer) EntryIDOf(taskName string) (cron.EntryID, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	task, ok := t.taskList[taskName]
+	return task.EntryID, ok
+}
+
+// SpecOf 返回任务添加时使用的执行计划
+func (t *TaskTimer) SpecOf(taskName string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	task, ok := t.taskList[taskName]
+	return task.spec, ok
+}
+
+// UnderlyingCron 返回任务所在的 *cron.Cron 任务不存在 已暂停或由 RunOnceNow 添加时第二个返回值为 false
+// 仅作为调用 TaskTimer 未提供的cron接口的后门 直接操作会绕过 TaskTimer 的记录
+// 不要通过它 Remove/AddFunc/Stop 否则任务列表和实例状态会与实际不一致
+func (t *TaskTimer) UnderlyingCron(taskName string) (*cron.Cron, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	task, ok := t.taskList[taskName]
+	if !ok || task.paused || task.direct {
+		return nil, false
 	}
+	return task.cronInst, true
 }
 
-func (m *cronManager) Stop() {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.cronInst.Stop()
-	m.status = RemovedStatus // 标记已经被移除
+// OptionsOf 返回任务所在cron实例的option描述 与复用cron实例时比较的描述相同 用于排查任务为什么分散在不同的实例上
+// 没有option时为空字符串 可识别的option形如 "loc=UTC;offset=0,0;parser=101/381" offset 为时区冬季和夏季的偏移秒数
+// parser 斜杠前的三位依次表示是否支持6段spec 5段spec和描述符 斜杠后为解析器的 ParseOption
+// 无法识别的option为 "opaque#N" 不会与其他任务共用实例
+func (t *TaskTimer) OptionsOf(taskName string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	task, ok := t.taskList[taskName]
+	if !ok {
+		return "", false
+	}
+	return task.optKey, true
 }
 
-func (m *cronManager) checkAlive() bool {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	return len(m.cronInst.Entries()) == 0
+// ListTasks 返回当前所有任务名 按名称排序
+func (t *TaskTimer) ListTasks() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	names := make([]string, 0, len(t.taskList))
+	for name := range t.taskList {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
-func (m *cronManager) checkIdle() bool {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	return m.status == IdleStatus
+// Range 按任务名顺序对每个任务调用 fn fn 返回 false 时停止
+// 调用前会先在锁内复制任务列表 fn 在锁外执行 可以在 fn 中调用 Remove 等方法
+// 遍历的是调用时的快照 fn 执行期间新增或删除的任务不会反映在本次遍历中 暂停的任务 id 为0
+func (t *TaskTimer) Range(fn func(taskName string, id cron.EntryID) bool) {
+	type item struct {
+		name string
+		id   cron.EntryID
+	}
+	t.mu.Lock()
+	items := make([]item, 0, len(t.taskList))
+	for name, task := range t.taskList {
+		items = append(items, item{name: name, id: task.EntryID})
+	}
+	t.mu.Unlock()
+
+	sort.Slice(items, func(i, j int) bool { return items[i].name < items[j].name })
+	for _, it := range items {
+		if !fn(it.name, it.id) {
+			return
+		}
+	}
 }
 
-type contextKey struct {
-	*cronManager
-	cron.EntryID
+// RunNow 立即在新的协程中执行一次任务 不影响原有的执行计划
+// 通过 WithDebounce 设置了防抖窗口的任务 在窗口内没有新的 RunNow 调用时才执行一次(后沿触发) 每次调用都会重新计时
+func (t *TaskTimer) RunNow(taskName string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrTimerClosed
+	}
+	task, ok := t.taskList[taskName]
+	if !ok {
+		return ErrTaskNotFound
+	}
+	job := t.wrapJob(taskName, task.job, task.state)
+	if window := t.debounce[taskName]; window > 0 {
+		task.state.debounceRun(window, job.Run)
+		return nil
+	}
+	go job.Run()
+	return nil
 }
 
-// TaskTimer 定时任务管理实现
-type TaskTimer struct {
-	taskList    map[string]contextKey
-	coreCron    [2]*cronManager // 保留2个核心cron 无option
-	mu          sync.Mutex      // 保护taskList和cron列表
-	dynamicCron []*cronManager  // 用于存储动态的cron实例
-	stopCheck   chan struct{}
-	checkWg     sync.WaitGroup
+// IsRunning 返回任务当前是否正在执行 包括 RunNow 触发的执行 与暂停状态无关
+func (t *TaskTimer) IsRunning(taskName string) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	task, ok := t.taskList[taskName]
+	if !ok {
+		return false, ErrTaskNotFound
+	}
+	return task.state.isRunning(), nil
 }
 
-// NewTaskTimer 创建一个新的 taskTimer 实例
-func NewTaskTimer() *TaskTimer {
-	t := &TaskTimer{
-		taskList:  make(map[string]contextKey, 10),
-		stopCheck: make(chan struct{}),
+// Count 返回当前的任务总数
+func (t *TaskTimer) Count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.taskList)
+}
+
+// CountByStatus 按状态统计核心cron和动态cron实例的数量
+func (t *TaskTimer) CountByStatus() map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts := map[string]int{
+		IdleStatus:    0,
+		BusyStatus:    0,
+		RemovedStatus: 0,
 	}
-	// 初始化核心cron
-	t.coreCron[0] = newCronManager()
-	t.coreCron[1] = newCronManager()
+	for _, mgr := range t.coreCron {
+		if mgr != nil {
+			counts[mgr.getStatus()]++
+		}
+	}
+	for _, mgr := range t.dynamicCron {
+		counts[mgr.getStatus()]++
+	}
+	return counts
+}
 
-	// 启动空闲cron检查协程
-	t.checkWg.Add(1)
-	go t.runIdleCheck()
+// DynamicCronCount 返回当前存活的动态cron实例数量 不包括2个核心cron
+func (t *TaskTimer) DynamicCronCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.dynamicCron)
+}
 
-	return t
+// PoolStats 动态cron的创建和销毁统计 创建和销毁频繁说明 idleTTL 过短或任务的option无法复用实例
+type PoolStats struct {
+	Created uint64 // 累计创建的动态cron数量
+	Reaped  uint64 // 累计销毁的动态cron数量 包括空闲回收和 Reset
+	Alive   int    // 当前存活的动态cron数量
 }
 
-// 使用预占 和 不使用释放预占位
-func (t *TaskTimer) getAliveCron(option ...cron.Option) *cronManager {
+// PoolStats 返回动态cron的创建和销毁统计
+func (t *TaskTimer) PoolStats() PoolStats {
+	t.mu.Lock()
+	alive := len(t.dynamicCron)
+	t.mu.Unlock()
+	return PoolStats{
+		Created: atomic.LoadUint64(&t.dynamicCreated),
+		Reaped:  atomic.LoadUint64(&t.dynamicReaped),
+		Alive:   alive,
+	}
+}
 
-	var insMgr *cronManager // 实际使用的cron实例
+// TaskInfo 任务的快照信息
+type TaskInfo struct {
+	Name    string
+	EntryID cron.EntryID
+	Spec    string
+	Status  string    // RunningState 或 PausedState
+	Next    time.Time // 下一次执行时间 暂停的任务为零值
+	Prev    time.Time // 上一次执行时间 尚未执行过为零值
+}
 
-	// 不存在option 找空闲核心cron
-	if option == nil {
-		for _, mgr := range t.coreCron {
-			if mgr.checkIdle() {
-				insMgr = mgr
-				break
-			}
+// Snapshot 返回所有任务的快照 按任务名排序 整个过程持有锁 保证快照的一致性
+func (t *TaskTimer) Snapshot() []TaskInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	infos := make([]TaskInfo, 0, len(t.taskList))
+	for name, task := range t.taskList {
+		info := TaskInfo{
+			Name:    name,
+			EntryID: task.EntryID,
+			Spec:    task.spec,
+			Status:  RunningState,
 		}
-		// 如果没有空闲核心cron，查找动态cron
-		if insMgr == nil {
-			for _, mgr := range t.dynamicCron {
-				if mgr.checkIdle() && mgr.option == nil {
-					insMgr = mgr
-				}
-			}
+		if task.paused {
+			info.Status = PausedState
+		} else {
+			entry := task.cronInst.Entry(task.EntryID)
+			info.Next = entry.Next
+			info.Prev = entry.Prev
 		}
-	} else {
-		for _, mgr := range t.dynamicCron {
-
-			if mgr.checkIdle() && mgr.option != nil && len(mgr.option) == len(option) {
-				count := 0                   // 每次判断一个cron的时候都重置成0
-				for _, opt := range option { // 标记option是不是都相同
-					for _, mgrOpt := range mgr.option {
-						if reflect.ValueOf(opt).Pointer() != reflect.ValueOf(mgrOpt).Pointer() {
-							count++
-						}
-					}
-				}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
 
-				if count == len(option) {
-					insMgr = mgr
-					break
-				}
+// TaskStats 任务的执行统计 返回错误(AddTaskByFuncWithResult 等)或panic记为失败
+type TaskStats struct {
+	Runs        uint64        // 执行完成的次数
+	Successes   uint64        // 成功的次数
+	Failures    uint64        // 失败的次数
+	LastRun     time.Time     // 最近一次开始执行的时间 尚未执行时为零值
+	AvgDuration time.Duration // 平均执行耗时
+	Detached    uint64        // 超时后分离执行的次数 见 WithDetachOnTimeout
+}
 
-			}
-		}
+// Stats 返回所有任务的执行统计 key 为任务名 计数由每个任务自己的锁保护 不占用 TaskTimer 的锁
+func (t *TaskTimer) Stats() map[string]TaskStats {
+	t.mu.Lock()
+	states := make(map[string]*taskState, len(t.taskList))
+	for name, task := range t.taskList {
+		states[name] = task.state
 	}
+	t.mu.Unlock()
 
-	if insMgr == nil {
-		insMgr = newCronManager(option...)
-		t.dynamicCron = append(t.dynamicCron, insMgr)
+	stats := make(map[string]TaskStats, len(states))
+	for name, state := range states {
+		stats[name] = state.stats()
 	}
+	return stats
+}
 
-	return insMgr
+// LastResult 返回任务最近一次执行完成的时间和返回的错误
+// 任务不存在或尚未有执行结果时 第三个返回值为 false
+func (t *TaskTimer) LastResult(taskName string) (time.Time, error, bool) {
+	t.mu.Lock()
+	task, ok := t.taskList[taskName]
+	t.mu.Unlock()
+	if !ok {
+		return time.Time{}, nil, false
+	}
+	return task.state.result()
+}
+
+// WaitForRuns 等待任务累计执行完成 n 次 最多等待 timeout 超时返回 ErrWaitTimeout 主要用于测试
+// 等待期间任务被删除(例如一次性任务执行后自动移除)不影响计数 任务不存在时返回 ErrTaskNotFound
+func (t *TaskTimer) WaitForRuns(taskName string, n int, timeout time.Duration) error {
+	t.mu.Lock()
+	task, ok := t.taskList[taskName]
+	t.mu.Unlock()
+	if !ok {
+		return ErrTaskNotFound
+	}
 
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for task.state.stats().Runs < uint64(n) {
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			return ErrWaitTimeout
+		}
+	}
+	return nil
 }
 
-// AddTaskByFunc 通过函数的方法添加任务
-func (t *TaskTimer) AddTaskByFunc(taskName string, spec string, task func(), option ...cron.Option) (cron.EntryID, error) {
+// History 返回任务最近的执行记录 最早的在前 需要通过 WithHistorySize 开启 任务不存在或未开启时返回 nil
+// 带返回值的任务记录执行结束时最近一次的错误
+func (t *TaskTimer) History(taskName string) []RunRecord {
+	t.mu.Lock()
+	task, ok := t.taskList[taskName]
+	t.mu.Unlock()
+	if !ok || t.historySize == 0 {
+		return nil
+	}
+	return task.state.runHistory()
+}
+
+// Distribution 返回每个cron实例上的任务名 key 为实例下标
+// 0 和 1 为核心cron 之后依次为动态cron 暂停的任务同样统计在原来的实例上
+func (t *TaskTimer) Distribution() map[int][]string {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	_, ok := t.taskList[taskName]
-	if !ok {
-		mgr := t.getAliveCron(option...)
-		taskId, err := mgr.cronInst.AddFunc(spec, task)
-		if err != nil {
-			return 0, err
+	dist := make(map[int][]string)
+	for name, task := range t.taskList {
+		if idx := t.managerIndex(task.cronManager); idx >= 0 {
+			dist[idx] = append(dist[idx], name)
 		}
-		t.taskList[taskName] = contextKey{
-			cronManager: mgr,
-			EntryID:     taskId,
+	}
+	for _, names := range dist {
+		sort.Strings(names)
+	}
+	return dist
+}
+
+// managerIndex 返回cron实例的下标 核心cron为 0 和 1 动态cron从 2 开始 找不到时返回 -1
+// 调用方需持有 t.mu
+func (t *TaskTimer) managerIndex(mgr *cronManager) int {
+	for i, core := range t.coreCron {
+		if core == mgr {
+			return i
 		}
-		if len(mgr.cronInst.Entries()) >= 20 {
-			mgr.status = BusyStatus
+	}
+	for i, dynamic := range t.dynamicCron {
+		if dynamic == mgr {
+			return len(t.coreCron) + i
 		}
-		return taskId, nil
 	}
-	return t.taskList[taskName].EntryID, errors.New("任务已经启动")
+	return -1
 }
 
-// OnceTask 一次性任务 只执行一次 执行完成之后 就会被移除
-func (t *TaskTimer) OnceTask(taskName string, spec string, task func(), option ...cron.Option) (cron.EntryID,
-	error) {
-	// 对提供的func 进行包装 自带一个 remove 方法
-	newTask := func() {
-		task()
-		time.Sleep(3 * time.Second)
-		t.Remove(taskName)
+// NextRun 返回任务下一次执行的时间
+func (t *TaskTimer) NextRun(taskName string) (time.Time, error) {
+	entry, err := t.entryOf(taskName)
+	if err != nil {
+		return time.Time{}, err
 	}
-	return t.AddTaskByFunc(taskName, spec, newTask, option...)
+	return entry.Next, nil
 }
 
-// AddTaskByJob 通过接口的方法添加任务
-func (t *TaskTimer) AddTaskByJob(taskName string, spec string, job interface{ Run() }, option ...cron.Option) (cron.EntryID, error) {
+// TimeUntilNext 返回距离任务下一次执行的时间 按 WithClock 设置的时间来源计算
+// 任务已暂停或不会再执行时返回 0 和 ErrNotScheduled 执行时间已到但尚未执行时返回 0 和 nil
+func (t *TaskTimer) TimeUntilNext(taskName string) (time.Duration, error) {
+	entry, err := t.entryOf(taskName)
+	if errors.Is(err, ErrEntryInvalid) {
+		return 0, ErrNotScheduled
+	}
+	if err != nil {
+		return 0, err
+	}
+	if entry.Next.IsZero() {
+		return 0, ErrNotScheduled
+	}
+	if d := entry.Next.Sub(t.clock.Now()); d > 0 {
+		return d, nil
+	}
+	return 0, nil
+}
+
+// PrevRun 返回任务上一次执行的时间 任务尚未执行过时返回零值 可以通过 IsZero 判断
+func (t *TaskTimer) PrevRun(taskName string) (time.Time, error) {
+	entry, err := t.entryOf(taskName)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return entry.Prev, nil
+}
+
+// entryOf 返回任务在cron中的条目
+func (t *TaskTimer) entryOf(taskName string) (cron.Entry, error) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	_, ok := t.taskList[taskName]
+	mgr, ok := t.taskList[taskName]
 	if !ok {
-		mgr := t.getAliveCron(option...)
-		taskId, err := mgr.cronInst.AddJob(spec, job)
-		if err != nil {
-			return 0, err
+		return cron.Entry{}, ErrTaskNotFound
+	}
+	entry := mgr.cronInst.Entry(mgr.EntryID)
+	if !entry.Valid() {
+		return cron.Entry{}, ErrEntryInvalid
+	}
+	return entry, nil
+}
+
+// Remove 清理任务实际上就是删除任务 任务不存在时返回 ErrTaskNotFound
+// 支持在任务自身的执行函数中调用 cron的任务在独立的协程中执行 cron.Remove 不会等待正在执行的任务
+// 本次执行会正常结束 之后不再触发
+func (t *TaskTimer) Remove(taskName string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrTimerClosed
+	}
+	return t.removeLocked(taskName)
+}
+
+// RemoveByID 按 EntryID 删除任务 没有对应的任务时返回 ErrTaskNotFound
+// EntryID 只在同一个cron实例内唯一 有多个任务匹配时不做删除 返回 ErrEntryAmbiguous 暂停的任务没有 EntryID
+func (t *TaskTimer) RemoveByID(id cron.EntryID) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrTimerClosed
+	}
+	var matched []string
+	for name, task := range t.taskList {
+		if !task.paused && !task.direct && task.EntryID == id {
+			matched = append(matched, name)
 		}
-		t.taskList[taskName] = contextKey{
-			cronManager: mgr,
-			EntryID:     taskId,
+	}
+	switch len(matched) {
+	case 0:
+		return ErrTaskNotFound
+	case 1:
+		return t.removeLocked(matched[0])
+	default:
+		return ErrEntryAmbiguous
+	}
+}
+
+// DrainTask 删除任务并等待正在执行的任务完成 最多等待 timeout 超时返回 ErrWaitTimeout
+// 超时后任务同样已经删除 只是仍在后台执行 等待在锁外进行 正在执行的任务可以调用 TaskTimer 的方法
+func (t *TaskTimer) DrainTask(taskName string, timeout time.Duration) error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return ErrTimerClosed
+	}
+	task, ok := t.taskList[taskName]
+	if ok {
+		t.removeLocked(taskName)
+	}
+	t.mu.Unlock()
+	if !ok {
+		return ErrTaskNotFound
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-task.state.waitIdle():
+		return nil
+	case <-timer.C:
+		return ErrWaitTimeout
+	}
+}
+
+// RemoveByPrefix 删除所有以 prefix 开头的任务 返回删除的数量
+func (t *TaskTimer) RemoveByPrefix(prefix string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	count := 0
+	for name := range t.taskList {
+		if strings.HasPrefix(name, prefix) && t.removeLocked(name) == nil {
+			count++
 		}
-		if len(mgr.cronInst.Entries()) >= 20 {
-			mgr.status = BusyStatus
+	}
+	return count
+}
+
+// RemoveByLabel 删除所有带有 label 标签的任务 返回删除的数量
+func (t *TaskTimer) RemoveByLabel(label string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	count := 0
+	for name, task := range t.taskList {
+		if task.hasLabel(label) && t.removeLocked(name) == nil {
+			count++
 		}
-		return taskId, nil
 	}
-	return t.taskList[taskName].EntryID, errors.New("任务已经启动")
+	return count
 }
 
-func (t *TaskTimer) FindTask(taskName string) bool {
+// RemoveAll 删除所有任务 返回删除的数量
+func (t *TaskTimer) RemoveAll() int {
+	return t.RemoveByPrefix("")
+}
+
+// Reset 删除所有任务并停止所有动态cron 保留2个空闲的核心cron TaskTimer 之后可以继续使用
+// 与 Close 不同 不会等待正在执行的任务 空闲检查协程继续运行
+func (t *TaskTimer) Reset() error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	_, ok := t.taskList[taskName]
-	return ok
+	if t.closed {
+		return ErrTimerClosed
+	}
+	for name := range t.taskList {
+		t.removeLocked(name)
+	}
+	for _, mgr := range t.dynamicCron {
+		t.reap(mgr)
+	}
+	t.dynamicCron = nil
+	return nil
 }
 
-// Remove 清理任务实际上就是删除任务
-func (t *TaskTimer) Remove(taskName string) {
+// removeByState 仅当任务仍是 state 对应的那一个时才删除 避免误删同名的新任务
+// 任务可能已经通过 Rename 改名 按 state 查找当前的任务名
+func (t *TaskTimer) removeByState(taskName string, state *taskState) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	mgr, ok := t.taskList[taskName]
-	if ok {
-		mgr.mu.Lock()
-		defer mgr.mu.Unlock()
-		mgr.cronInst.Remove(mgr.EntryID)
-		delete(t.taskList, taskName)
-		if len(mgr.cronInst.Entries()) < 20 && mgr.status == BusyStatus {
-			mgr.status = IdleStatus
+	if name, ok := t.nameOfStateLocked(state, taskName); ok {
+		t.removeLocked(name)
+	}
+}
+
+// nameOfStateLocked 返回 state 所属任务当前的任务名 优先检查 hint 调用方需持有 t.mu
+func (t *TaskTimer) nameOfStateLocked(state *taskState, hint ...string) (string, bool) {
+	for _, name := range hint {
+		if task, ok := t.taskList[name]; ok && task.state == state {
+			return name, true
 		}
 	}
+	for name, task := range t.taskList {
+		if task.state == state {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// removeLocked 删除任务 调用方需持有 t.mu
+func (t *TaskTimer) removeLocked(taskName string) error {
+	task, ok := t.taskList[taskName]
+	if !ok {
+		return ErrTaskNotFound
+	}
+	t.discardLocked(task)
+	delete(t.taskList, taskName)
+	t.emit(taskName, EventRemoved)
+	return nil
+}
+
+// discardLocked 从cron中移除任务并释放任务的上下文和防抖定时器 不修改 taskList 调用方需持有 t.mu
+func (t *TaskTimer) discardLocked(task contextKey) {
+	if !task.paused { // 暂停的任务已经不在cron中
+		t.detach(task)
+	}
+	task.cancelCtx()
+	task.state.stopDebounce()
 }
 
-// Close 释放所有资源 资源释放之后 再使用 需要通过 new 重新创建
+// Close 释放所有资源 会等待正在执行的任务完成 资源释放之后 再使用 需要通过 new 重新创建
+// 不能在任务的执行函数中调用 Close 会一直等待自身执行完成 DrainTask 同理
+// 重复调用 Close 是安全的 之后的调用不做任何处理
 func (t *TaskTimer) Close() {
+	for _, ctx := range t.shutdown() {
+		<-ctx.Done()
+	}
+}
+
+// CloseWithTimeout 与 Close 相同 但最多等待 d 时间 超时返回 ErrCloseTimeout
+// 超时后资源同样已经释放 只是仍有任务在后台执行
+func (t *TaskTimer) CloseWithTimeout(d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for _, ctx := range t.shutdown() {
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+			return ErrCloseTimeout
+		}
+	}
+	return nil
+}
+
+// shutdown 停止所有cron实例并释放资源 返回每个实例正在执行任务的等待context
+// 等待需要在锁外进行 正在执行的任务可能会调用 Remove
+// 只有第一次调用会释放资源 之后的调用直接返回 nil
+func (t *TaskTimer) shutdown() []context.Context {
+	var running []context.Context
+	t.closeOnce.Do(func() {
+		running = t.release()
+	})
+	return running
+}
+
+// release 释放所有资源 只能调用一次
+func (t *TaskTimer) release() []context.Context {
 	// 停止空闲检查协程
 	close(t.stopCheck)
 	t.checkWg.Wait()
@@ -228,57 +2943,122 @@ func (t *TaskTimer) Close() {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
+	t.closed = true
+	for _, ch := range t.subscribers {
+		close(ch)
+	}
+	t.subscribers = nil
+	for _, task := range t.taskList {
+		task.cancelCtx()
+		task.state.stopDebounce()
+	}
 	t.taskList = nil // 将任务队列置为空
 
+	running := make([]context.Context, 0, len(t.coreCron)+len(t.dynamicCron))
 	for _, mgr := range t.coreCron {
-		mgr.Stop()
+		running = append(running, mgr.Stop())
 	}
 	for _, mgr := range t.dynamicCron {
-		mgr.Stop()
+		running = append(running, mgr.Stop())
 	}
 	t.dynamicCron = nil
+	running = append(running, t.waitDirect())
 
 	t.coreCron[0] = nil
 	t.coreCron[1] = nil
+	if t.pool != nil {
+		running = append(running, t.pool.stop())
+	}
+	return running
 }
 
-// runIdleCheck 定期检查空闲的cron实例并销毁
-func (t *TaskTimer) runIdleCheck() {
-	defer t.checkWg.Done()
-	ticker := time.NewTicker(1 * time.Hour) // 每个小时刷新一次
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Println("runIdleCheck panic:", r)
-			t.runIdleCheck()
-		}
+// waitDirect 返回的context在所有 RunOnceNow 任务执行完成后关闭 调用方需持有 t.mu 且已经标记关闭
+func (t *TaskTimer) waitDirect() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		t.directWg.Wait()
+		cancel()
 	}()
+	return ctx
+}
 
-	defer func() {
-		ticker.Stop()
-		ticker = nil
-	}()
+// runIdleCheck 定期检查空闲的cron实例并销毁 在 TaskTimer 的整个生命周期内只有一个检查协程
+func (t *TaskTimer) runIdleCheck() {
+	defer t.checkWg.Done()
+	ticker := time.NewTicker(t.idleCheckInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			t.checkIdleCron()
+			t.safeCheckIdleCron()
+			t.beat()
 		case <-t.stopCheck:
 			return
 		}
 	}
 }
 
-// checkIdleCron 检查并销毁空闲的cron实例
-func (t *TaskTimer) checkIdleCron() {
+// beat 记录空闲检查协程的心跳 使用真实时间 与 ticker 保持一致
+func (t *TaskTimer) beat() {
+	atomic.StoreInt64(&t.heartbeat, time.Now().UnixNano())
+}
+
+// IsClosed 返回是否已经调用过 Close
+func (t *TaskTimer) IsClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}
+
+// HealthCheck 检查定时器是否健康 空闲检查协程超过两个检查间隔没有心跳时返回 ErrReaperStalled
+// 通过 WithAutoReap(false) 关闭检查协程时不做心跳判断
+func (t *TaskTimer) HealthCheck() error {
+	t.mu.Lock()
+	closed := t.closed
+	t.mu.Unlock()
+	if closed {
+		return ErrTimerClosed
+	}
+	if !t.autoReap {
+		return nil
+	}
+	last := time.Unix(0, atomic.LoadInt64(&t.heartbeat))
+	if since := time.Since(last); since > 2*t.idleCheckInterval {
+		return fmt.Errorf("%w: 距离上次运行 %s", ErrReaperStalled, since)
+	}
+	return nil
+}
+
+// safeCheckIdleCron 执行一次空闲检查 panic会被恢复 检查协程继续运行
+func (t *TaskTimer) safeCheckIdleCron() {
+	defer func() {
+		if r := recover(); r != nil {
+			t.logger.Error(fmt.Errorf("%v", r), "空闲检查panic")
+		}
+	}()
+	t.checkIdleCron()
+}
+
+// ReapIdle 立即执行一次空闲检查 返回销毁的动态cron数量 与自动回收使用相同的 idleTTL 和时间来源
+// 关闭 WithAutoReap 时可以通过它手动回收
+func (t *TaskTimer) ReapIdle() int {
+	return t.checkIdleCron()
+}
+
+// checkIdleCron 检查并销毁空闲的cron实例 返回销毁的数量
+func (t *TaskTimer) checkIdleCron() int {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
 	var aliveCron []*cronManager
 	for _, mgr := range t.dynamicCron {
-		if mgr.checkAlive() && time.Since(mgr.lastUsed) > 2*time.Hour { // 2小时未使用则销毁
-			mgr.Stop()
+		if mgr.isEmpty() && t.clock.Now().Sub(mgr.lastUsedAt()) > t.idleTTL { // 超过idleTTL未使用则销毁
+			t.reap(mgr)
 		} else {
 			aliveCron = append(aliveCron, mgr)
 		}
 	}
+	reaped := len(t.dynamicCron) - len(aliveCron)
 	t.dynamicCron = aliveCron
+	return reaped
 }
@@ -0,0 +1,727 @@
+package timer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// fakeClock 可以手动拨动的时间来源
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// waitFor 等待 cond 成立 超时返回 false
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+// taskListed 直接检查 taskList 中是否还有任务记录
+func taskListed(tt *TaskTimer, taskName string) bool {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	_, ok := tt.taskList[taskName]
+	return ok
+}
+
+// 动态cron上的任务删除后 在 idleTTL 之内不会被销毁 超过之后才会销毁
+func TestDynamicCronSurvivesWithinTTL(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	tt := NewTaskTimer(WithClock(clock), WithAutoReap(false))
+	defer tt.Close()
+
+	// 带option的任务分配到动态cron
+	if _, err := tt.AddTaskByFunc("dyn", "* * * * * *", func() {}, cron.WithSeconds()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(tt.dynamicCron); n != 1 {
+		t.Fatalf("动态cron数量为 %d 期望为 1", n)
+	}
+	clock.Add(time.Hour)
+	if err := tt.Remove("dyn"); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Add(defaultIdleTTL - time.Minute)
+	if reaped := tt.checkIdleCron(); reaped != 0 {
+		t.Fatalf("idleTTL 之内销毁了 %d 个动态cron", reaped)
+	}
+	if n := len(tt.dynamicCron); n != 1 {
+		t.Fatalf("动态cron数量为 %d 期望为 1", n)
+	}
+
+	clock.Add(2 * time.Minute)
+	if reaped := tt.checkIdleCron(); reaped != 1 {
+		t.Fatalf("超过 idleTTL 后销毁了 %d 个动态cron 期望为 1", reaped)
+	}
+}
+
+// 一次性任务只执行一次 执行后从 taskList 中移除
+func TestOnceTaskRunsOnce(t *testing.T) {
+	tt := NewTaskTimer()
+	defer tt.Close()
+
+	var runs int32
+	if _, err := tt.OnceTask("once", "@every 1s", func() { atomic.AddInt32(&runs, 1) }); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(3*time.Second, func() bool { return !taskListed(tt, "once") }) {
+		t.Fatal("一次性任务执行后没有被移除")
+	}
+	// 再等过下一次调度时间 确认不会再执行
+	time.Sleep(1500 * time.Millisecond)
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Fatalf("一次性任务执行了 %d 次", n)
+	}
+}
+
+// 重复调用 Close 不会panic
+func TestCloseTwice(t *testing.T) {
+	tt := NewTaskTimer()
+	if _, err := tt.AddTaskByFunc("task", "* * * * *", func() {}); err != nil {
+		t.Fatal(err)
+	}
+	tt.Close()
+	tt.Close()
+	if !tt.IsClosed() {
+		t.Fatal("Close 之后 IsClosed 返回 false")
+	}
+}
+
+// recordLogger 记录 Error 的调用次数
+type recordLogger struct {
+	errors int32
+}
+
+func (l *recordLogger) Info(msg string, keysAndValues ...interface{}) {}
+
+func (l *recordLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	atomic.AddInt32(&l.errors, 1)
+}
+
+// checkIdleCron 中panic后 检查协程继续运行 Close 仍然可以返回
+func TestIdleCheckRecoversPanic(t *testing.T) {
+	var calls int32
+	logger := &recordLogger{}
+	tt := NewTaskTimer(
+		WithLogger(logger),
+		WithIdleCheckInterval(20*time.Millisecond),
+		WithIdleTTL(time.Nanosecond),
+		WithCronReapHandler(func(c *cron.Cron) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				panic("reap")
+			}
+		}),
+	)
+	if _, err := tt.AddTaskByFunc("dyn", "* * * * * *", func() {}, cron.WithSeconds()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tt.Remove("dyn"); err != nil {
+		t.Fatal(err)
+	}
+	// 第一次检查panic 之后的检查重新销毁该实例
+	if !waitFor(2*time.Second, func() bool { return atomic.LoadInt32(&calls) >= 2 }) {
+		t.Fatal("panic之后检查协程没有继续运行")
+	}
+	if atomic.LoadInt32(&logger.errors) == 0 {
+		t.Fatal("panic没有记录到日志")
+	}
+	if err := tt.CloseWithTimeout(time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 关闭自动回收时不启动检查协程 Close 不会等待不存在的协程
+func TestAutoReapDisabled(t *testing.T) {
+	tt := NewTaskTimer(WithAutoReap(false), WithIdleCheckInterval(10*time.Millisecond), WithIdleTTL(time.Nanosecond))
+	if _, err := tt.AddTaskByFunc("dyn", "* * * * * *", func() {}, cron.WithSeconds()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tt.Remove("dyn"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// 检查协程启动时和每次检查后都会记录心跳
+	if hb := atomic.LoadInt64(&tt.heartbeat); hb != 0 {
+		t.Fatal("关闭自动回收后检查协程仍然在运行")
+	}
+	if n := len(tt.dynamicCron); n != 1 {
+		t.Fatalf("动态cron数量为 %d 期望为 1", n)
+	}
+	if err := tt.CloseWithTimeout(time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 秒级精度下一次性任务可以使用6段spec 同样只执行一次
+func TestOnceTaskSecondsSpec(t *testing.T) {
+	tt := NewTaskTimer(WithSecondsPrecision())
+	defer tt.Close()
+
+	var runs int32
+	if _, err := tt.OnceTask("once", "* * * * * *", func() { atomic.AddInt32(&runs, 1) }); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(3*time.Second, func() bool { return !taskListed(tt, "once") }) {
+		t.Fatal("一次性任务执行后没有被移除")
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Fatalf("一次性任务执行了 %d 次", n)
+	}
+}
+
+// 并发添加任务和 Close 不会panic 添加只会成功或者返回 ErrTimerClosed
+func TestAddCloseStress(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		tt := NewTaskTimer(WithBusyThreshold(2))
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					name := fmt.Sprintf("task-%d-%d", g, i)
+					var err error
+					if i%2 == 0 {
+						_, err = tt.AddTaskByFunc(name, "* * * * *", func() {})
+					} else {
+						_, err = tt.AddTaskByFunc(name, "* * * * * *", func() {}, cron.WithSeconds())
+					}
+					if err != nil && !errors.Is(err, ErrTimerClosed) {
+						t.Errorf("添加任务 %s 失败: %v", name, err)
+					}
+				}
+			}(g)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(time.Duration(round%5) * time.Millisecond)
+			tt.Close()
+		}()
+		wg.Wait()
+		if _, err := tt.AddTaskByFunc("after", "* * * * *", func() {}); !errors.Is(err, ErrTimerClosed) {
+			t.Fatalf("关闭之后添加任务返回 %v", err)
+		}
+	}
+}
+
+// 默认和秒级精度下都支持描述符 @every 的间隔小于1秒时按1秒执行
+func TestDescriptors(t *testing.T) {
+	for _, opts := range [][]TimerOption{nil, {WithSecondsPrecision()}} {
+		tt := NewTaskTimer(opts...)
+
+		if _, err := tt.AddTaskByFunc("hourly", "@hourly", func() {}); err != nil {
+			t.Fatal(err)
+		}
+		next, err := tt.NextRun("hourly")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait := time.Until(next); next.Minute() != 0 || next.Second() != 0 || wait <= 0 || wait > time.Hour {
+			t.Fatalf("@hourly 的下次执行时间为 %s 期望为下一个整点", next)
+		}
+
+		var runs int32
+		id, err := tt.AddTaskByFunc("every", "@every 500ms", func() { atomic.AddInt32(&runs, 1) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, _ := tt.UnderlyingCron("every")
+		schedule, ok := c.Entry(id).Schedule.(cron.ConstantDelaySchedule)
+		if !ok || schedule.Delay != time.Second {
+			t.Fatalf("@every 500ms 的执行计划为 %#v 期望间隔为1秒", c.Entry(id).Schedule)
+		}
+		time.Sleep(2500 * time.Millisecond)
+		if n := atomic.LoadInt32(&runs); n < 1 || n > 3 {
+			t.Fatalf("@every 500ms 在2.5秒内执行了 %d 次", n)
+		}
+		tt.Close()
+	}
+}
+
+// 没有option的任务平均分配到两个核心cron
+func TestCoreCronEvenDistribution(t *testing.T) {
+	tt := NewTaskTimer()
+	defer tt.Close()
+
+	for i := 0; i < 30; i++ {
+		if _, err := tt.AddTaskByFunc(fmt.Sprintf("task-%d", i), "* * * * *", func() {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a, b := tt.coreCron[0].entryCount(), tt.coreCron[1].entryCount(); a != 15 || b != 15 {
+		t.Fatalf("核心cron的任务数为 %d/%d 期望为 15/15", a, b)
+	}
+	if n := len(tt.dynamicCron); n != 0 {
+		t.Fatalf("创建了 %d 个动态cron", n)
+	}
+}
+
+// 任务在执行中删除自己不会死锁 删除后定时器仍然可用
+func TestTaskRemovesItself(t *testing.T) {
+	tt := NewTaskTimer(WithSecondsPrecision())
+	defer tt.Close()
+
+	removed := make(chan error, 1)
+	if _, err := tt.AddTaskByFunc("self", "* * * * * *", func() {
+		removed <- tt.Remove("self")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-removed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("任务没有执行或者删除自己时死锁")
+	}
+	if tt.FindTask("self") || taskListed(tt, "self") {
+		t.Fatal("任务删除自己之后仍然存在")
+	}
+	if _, err := tt.AddTaskByFunc("self", "* * * * * *", func() {}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// OnceReplace 替换失败时保留原来的任务
+func TestOnceReplaceKeepsTaskOnError(t *testing.T) {
+	tt := NewTaskTimer(WithOnceDuplicatePolicy(OnceReplace))
+	defer tt.Close()
+
+	oldID, err := tt.OnceTask("x", "@every 1h", func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tt.OnceTask("x", "garbage", func() {}); err == nil {
+		t.Fatal("无效的spec没有返回错误")
+	}
+	if id, ok := tt.EntryIDOf("x"); !ok || id != oldID {
+		t.Fatal("替换失败后原来的任务被删除")
+	}
+	if _, err = tt.OnceTask("x", "@every 2h", func() {}); err != nil {
+		t.Fatal(err)
+	}
+	// 旧任务的条目已经从cron中移除
+	if n := tt.coreCron[0].entryCount() + tt.coreCron[1].entryCount(); n != 1 {
+		t.Fatalf("替换后cron中有 %d 个条目 期望为 1", n)
+	}
+}
+
+// 一次性任务panic时同样会被移除 panic交给 WithPanicHandler 处理
+func TestOnceTaskPanicRemoved(t *testing.T) {
+	var handled int32
+	tt := NewTaskTimer(WithPanicHandler(func(taskName string, recovered interface{}) {
+		atomic.AddInt32(&handled, 1)
+	}))
+	defer tt.Close()
+
+	if _, err := tt.OnceTask("boom", "@every 1s", func() { panic("boom") }); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(3*time.Second, func() bool { return !taskListed(tt, "boom") }) {
+		t.Fatal("panic的一次性任务没有被移除")
+	}
+	if n := atomic.LoadInt32(&handled); n != 1 {
+		t.Fatalf("panic处理函数调用了 %d 次", n)
+	}
+}
+
+// 被依赖的任务改名后 依赖它的任务仍然按它的执行结果执行
+func TestRenameKeepsDependency(t *testing.T) {
+	tt := NewTaskTimer(WithSecondsPrecision())
+	defer tt.Close()
+
+	if _, err := tt.AddTaskByFunc("parent", "* * * * * *", func() {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tt.WaitForRuns("parent", 1, 3*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := tt.Rename("parent", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	var runs int32
+	if err := tt.AddDependentTask("child", "parent", "* * * * * *", func() { atomic.AddInt32(&runs, 1) }); !errors.Is(err, ErrTaskNotFound) {
+		t.Fatalf("依赖不存在的任务名返回 %v", err)
+	}
+	if err := tt.AddDependentTask("child", "renamed", "* * * * * *", func() { atomic.AddInt32(&runs, 1) }); err != nil {
+		t.Fatal(err)
+	}
+	if err := tt.Rename("renamed", "parent2"); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(3*time.Second, func() bool { return atomic.LoadInt32(&runs) > 0 }) {
+		t.Fatal("依赖的任务改名后 子任务不再执行")
+	}
+}
+
+// 改名后 panic处理和执行回调收到的是新的任务名
+func TestRenameReportsNewName(t *testing.T) {
+	var mu sync.Mutex
+	var panicked, before []string
+	tt := NewTaskTimer(WithSecondsPrecision(),
+		WithPanicHandler(func(taskName string, recovered interface{}) {
+			mu.Lock()
+			panicked = append(panicked, taskName)
+			mu.Unlock()
+		}),
+		WithBeforeRun(func(taskName string) {
+			mu.Lock()
+			before = append(before, taskName)
+			mu.Unlock()
+		}))
+	defer tt.Close()
+
+	if _, err := tt.AddTaskByFunc("old", "* * * * * *", func() { panic("boom") }); err != nil {
+		t.Fatal(err)
+	}
+	if err := tt.Rename("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	ran := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(panicked) > 0 && len(before) > 0
+	}
+	if !waitFor(3*time.Second, ran) {
+		t.Fatal("任务没有执行")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, name := range append(append([]string(nil), panicked...), before...) {
+		if name != "new" {
+			t.Fatalf("改名后上报的任务名是 %q", name)
+		}
+	}
+}
+
+// 一次性任务重新注册(Pause/Resume UpdateSchedule)后 执行完成同样会被移除
+func TestOnceTaskRemovedAfterReregister(t *testing.T) {
+	reregister := map[string]func(tt *TaskTimer) error{
+		"PauseResume": func(tt *TaskTimer) error {
+			if err := tt.Pause("once"); err != nil {
+				return err
+			}
+			return tt.Resume("once")
+		},
+		"UpdateSchedule": func(tt *TaskTimer) error {
+			return tt.UpdateSchedule("once", "@every 1s")
+		},
+	}
+	for name, fn := range reregister {
+		t.Run(name, func(t *testing.T) {
+			tt := NewTaskTimer()
+			defer tt.Close()
+
+			var runs int32
+			if _, err := tt.OnceTask("once", "@every 1s", func() { atomic.AddInt32(&runs, 1) }); err != nil {
+				t.Fatal(err)
+			}
+			if err := fn(tt); err != nil {
+				t.Fatal(err)
+			}
+			if !waitFor(3*time.Second, func() bool { return !taskListed(tt, "once") }) {
+				t.Fatal("重新注册后一次性任务执行完成没有被移除")
+			}
+			if n := atomic.LoadInt32(&runs); n != 1 {
+				t.Fatalf("一次性任务执行了 %d 次", n)
+			}
+		})
+	}
+}
+
+// 一次性任务替换执行函数后仍然只执行一次 执行后移除
+func TestReplaceFuncKeepsOnce(t *testing.T) {
+	tt := NewTaskTimer()
+	defer tt.Close()
+
+	var runs int32
+	if _, err := tt.OnceTask("once", "@every 1s", func() {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tt.ReplaceFunc("once", func() { atomic.AddInt32(&runs, 1) }); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(3*time.Second, func() bool { return !taskListed(tt, "once") }) {
+		t.Fatal("替换后一次性任务执行完成没有被移除")
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Fatalf("替换后的函数执行了 %d 次", n)
+	}
+}
+
+// 替换到新的cron实例失败时 为其创建的动态cron被立即回收
+func TestUpsertFailureDropsNewCron(t *testing.T) {
+	tt := NewTaskTimer()
+	defer tt.Close()
+
+	if _, err := tt.AddTaskByFunc("task", "* * * * *", func() {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tt.Pause("task"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tt.UpsertTaskByFunc("task", "garbage", func() {}, cron.WithSeconds()); err == nil {
+		t.Fatal("无效的spec没有返回错误")
+	}
+	if _, err := tt.UpsertTaskByFunc("task", "* * * * * *", func() {}, cron.WithLocation(time.UTC)); err == nil {
+		t.Fatal("无效的spec没有返回错误")
+	}
+	if n := tt.DynamicCronCount(); n != 0 {
+		t.Fatalf("替换失败后残留了 %d 个动态cron", n)
+	}
+}
+
+// 一次性任务通过 UpsertTaskByFunc 替换后仍然只执行一次
+func TestUpsertKeepsOnce(t *testing.T) {
+	tt := NewTaskTimer()
+	defer tt.Close()
+
+	var runs int32
+	if _, err := tt.OnceTask("once", "@every 1h", func() {}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tt.UpsertTaskByFunc("once", "@every 1s", func() { atomic.AddInt32(&runs, 1) }); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(3*time.Second, func() bool { return !taskListed(tt, "once") }) {
+		t.Fatal("替换后一次性任务执行完成没有被移除")
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Fatalf("替换后的函数执行了 %d 次", n)
+	}
+}
+
+// ApplySet 中途失败时回滚 任务集合保持调用前的状态
+func TestApplySetRollback(t *testing.T) {
+	tt := NewTaskTimer(WithMaxDynamicCrons(1))
+	defer tt.Close()
+
+	var runs int32
+	if _, err := tt.AddTaskByFunc("old", "* * * * * *", func() { atomic.AddInt32(&runs, 1) }, cron.WithSeconds()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tt.AddTaskByFunc("keep", "* * * * *", func() {}); err != nil {
+		t.Fatal(err)
+	}
+	// 需要新的动态cron 超过上限
+	added, removed, updated, err := tt.ApplySet([]TaskDef{
+		{Name: "keep", Spec: "*/2 * * * *", Func: func() {}},
+		{Name: "n1", Spec: "* * * * *", Func: func() {}},
+		{Name: "n2", Spec: "* * * * *", Func: func() {}, Options: []cron.Option{cron.WithLocation(time.UTC)}},
+	})
+	if !errors.Is(err, ErrPoolFull) {
+		t.Fatalf("ApplySet 返回 %v 期望为 ErrPoolFull", err)
+	}
+	if added != 0 || removed != 0 || updated != 0 {
+		t.Fatalf("回滚后返回的数量为 %d/%d/%d", added, removed, updated)
+	}
+	if names := fmt.Sprint(tt.ListTasks()); names != "[keep old]" {
+		t.Fatalf("回滚后的任务为 %s", names)
+	}
+	if spec, _ := tt.SpecOf("keep"); spec != "* * * * *" {
+		t.Fatalf("回滚后 keep 的spec为 %q", spec)
+	}
+	if n := tt.coreCron[0].entryCount() + tt.coreCron[1].entryCount(); n != 1 {
+		t.Fatalf("回滚后核心cron中有 %d 个条目 期望为 1", n)
+	}
+	// 被恢复的任务仍然正常执行
+	if !waitFor(2*time.Second, func() bool { return atomic.LoadInt32(&runs) > 0 }) {
+		t.Fatal("回滚后恢复的任务没有执行")
+	}
+
+	added, removed, updated, err = tt.ApplySet([]TaskDef{
+		{Name: "keep", Spec: "*/2 * * * *", Func: func() {}},
+		{Name: "n1", Spec: "* * * * *", Func: func() {}},
+	})
+	if err != nil || added != 1 || removed != 1 || updated != 1 {
+		t.Fatalf("ApplySet 返回 %d/%d/%d %v", added, removed, updated, err)
+	}
+	if names := fmt.Sprint(tt.ListTasks()); names != "[keep n1]" {
+		t.Fatalf("应用后的任务为 %s", names)
+	}
+}
+
+// 一次性任务导入后仍然只执行一次 无法还原option的任务作为错误返回
+func TestExportImportOnceAndOpaque(t *testing.T) {
+	src := NewTaskTimer()
+	defer src.Close()
+	if _, err := src.OnceTask("once", "@every 1s", func() {}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.AddTaskByFunc("opaque", "* * * * *", func() {}, cron.WithChain()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := src.ExportTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := NewTaskTimer()
+	defer dst.Close()
+	var runs int32
+	err = dst.ImportTasks(data, func(name string) func() {
+		return func() { atomic.AddInt32(&runs, 1) }
+	})
+	if err == nil {
+		t.Fatal("无法还原option的任务没有返回错误")
+	}
+	if dst.FindTask("opaque") {
+		t.Fatal("无法还原option的任务被导入")
+	}
+	if !waitFor(3*time.Second, func() bool { return !taskListed(dst, "once") }) {
+		t.Fatal("导入的一次性任务执行后没有被移除")
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Fatalf("导入的一次性任务执行了 %d 次", n)
+	}
+}
+
+// RunOnceNow 不添加cron条目 不受实例数量上限的限制 执行后移除 Close 等待其执行完成
+func TestRunOnceNowDirect(t *testing.T) {
+	tt := NewTaskTimer(WithMaxDynamicCrons(1), WithBusyThreshold(1))
+	if _, err := tt.AddTaskByFunc("a", "* * * * *", func() {}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tt.AddTaskByFunc("b", "* * * * *", func() {}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tt.AddTaskByFunc("c", "* * * * *", func() {}); err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	var done int32
+	if err := tt.RunOnceNow("now", func() {
+		<-release
+		atomic.StoreInt32(&done, 1)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !tt.FindTask("now") {
+		t.Fatal("执行期间任务不在任务列表中")
+	}
+	if err := tt.RunOnceNow("now", func() {}); !errors.Is(err, ErrTaskExists) {
+		t.Fatalf("同名任务返回 %v", err)
+	}
+	if err := tt.Pause("now"); !errors.Is(err, ErrNotScheduled) {
+		t.Fatalf("暂停 RunOnceNow 任务返回 %v", err)
+	}
+	if n := tt.DynamicCronCount(); n != 1 {
+		t.Fatalf("动态cron数量为 %d 期望为 1", n)
+	}
+	close(release)
+	if !waitFor(time.Second, func() bool { return !tt.FindTask("now") }) {
+		t.Fatal("任务执行完成后没有被移除")
+	}
+
+	release = make(chan struct{})
+	if err := tt.RunOnceNow("slow", func() {
+		<-release
+		atomic.StoreInt32(&done, 2)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	tt.Close()
+	if atomic.LoadInt32(&done) != 2 {
+		t.Fatal("Close 没有等待 RunOnceNow 任务执行完成")
+	}
+}
+
+// 注册失败后立即回收的动态cron同样调用回收回调并发出 EventReaped
+func TestDropUnusedCallsReapHandler(t *testing.T) {
+	var reaped int32
+	tt := NewTaskTimer(WithCronReapHandler(func(c *cron.Cron) { atomic.AddInt32(&reaped, 1) }))
+	defer tt.Close()
+	events := tt.Events()
+
+	if _, err := tt.AddTaskByFunc("bad", "garbage", func() {}, cron.WithSeconds()); err == nil {
+		t.Fatal("无效的spec没有返回错误")
+	}
+	if n := tt.DynamicCronCount(); n != 0 {
+		t.Fatalf("残留了 %d 个动态cron", n)
+	}
+	if n := atomic.LoadInt32(&reaped); n != 1 {
+		t.Fatalf("回收回调调用了 %d 次", n)
+	}
+	select {
+	case ev := <-events:
+		if ev.Type != EventReaped {
+			t.Fatalf("事件为 %s 期望为 %s", ev.Type, EventReaped)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("没有收到 EventReaped")
+	}
+}
+
+// parserKey 通过反射读取 cron v3.0.1 未导出的 parser 字段 升级依赖后字段变化时这里会失败
+// 否则所有带option的任务都会变成 opaque# 描述 不再共用cron实例 也无法导出
+func TestParserKeyReflection(t *testing.T) {
+	standard := cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor
+	cases := []struct {
+		name   string
+		option []cron.Option
+		want   cron.ParseOption
+	}{
+		{"default", nil, standard},
+		{"seconds", []cron.Option{cron.WithSeconds()}, cron.Second | standard},
+		{"parser", []cron.Option{cron.WithParser(secondsParser)}, cron.SecondOptional | standard},
+	}
+	for _, c := range cases {
+		key, ok := parserKey(cron.New(c.option...))
+		if !ok {
+			t.Fatalf("%s: 无法读取cron的解析器", c.name)
+		}
+		if want := fmt.Sprint(int(c.want)); key != want {
+			t.Fatalf("%s: 解析器描述为 %s 期望为 %s", c.name, key, want)
+		}
+	}
+
+	key := optionKey(cron.WithSeconds(), cron.WithLocation(time.FixedZone("TEST", 3600)))
+	if strings.HasPrefix(key, "opaque#") {
+		t.Fatalf("可识别的option生成了 %s", key)
+	}
+	option, err := optionsFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := optionKey(option...); got != key {
+		t.Fatalf("还原后的描述为 %s 期望为 %s", got, key)
+	}
+}